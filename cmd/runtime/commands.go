@@ -0,0 +1,637 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"myruntime/pkg/attach"
+	"myruntime/pkg/cgroup"
+	"myruntime/pkg/fs"
+	"myruntime/pkg/health"
+	"myruntime/pkg/logs"
+	"myruntime/pkg/sandbox"
+	"myruntime/pkg/state"
+	"myruntime/pkg/userns"
+
+	"golang.org/x/sys/unix"
+)
+
+// commands manage containers recorded in the state store, each gets the
+// arguments after its name
+var commands = map[string]func(args []string) int{
+	"ps":      psCmd,
+	"inspect": inspectCmd,
+	"stop":    stopCmd,
+	"kill":    killCmd,
+	"start":   startCmd,
+	"rm":      rmCmd,
+	"wait":    waitCmd,
+	"exec":    execCmd,
+	"logs":    logsCmd,
+	"attach":  attachCmd,
+	"pause":   pauseCmd,
+	"unpause": unpauseCmd,
+	"oci":     ociCmd,
+}
+
+// openStore enters the rootless namespace like run does, the records of
+// rootless containers live where only it looks
+func openStore() {
+	if os.Geteuid() != 0 || userns.Rootless() {
+		if err := userns.EnterRootless(); err != nil {
+			fatalf("rootless setup failed: %v", err)
+		}
+	}
+	store = state.Store{Root: state.DefaultRoot()}
+}
+
+// eachContainer runs fn on the containers refs name, reporting failures
+func eachContainer(refs []string, fn func(c *state.Container) error) int {
+	if len(refs) == 0 {
+		fatalf("no container given")
+	}
+	status := 0
+	for _, ref := range refs {
+		c, err := store.Lookup(ref)
+		if err == nil {
+			err = fn(c)
+		}
+		if err != nil {
+			log.Printf("%s: %v", ref, err)
+			status = sandbox.ExitRuntimeError
+		}
+	}
+	return status
+}
+
+// stopped reports whether c is no longer running. The record of a container
+// whose runtime died with it stays "running", so both processes are checked.
+// A restarting container is up for as long as its runtime is.
+func stopped(c *state.Container) bool {
+	shimGone := c.ShimPid <= 0 || syscall.Kill(c.ShimPid, 0) == syscall.ESRCH
+	switch c.Status {
+	case state.Running:
+		return !c.Alive() && shimGone
+	case state.Restarting:
+		return shimGone
+	}
+	return true
+}
+
+// requestStop keeps the restart policy from running container id again
+func requestStop(id string) error {
+	return store.Update(id, func(c *state.Container) error {
+		c.StopRequested = true
+		return nil
+	})
+}
+
+// waitStopped polls the record of id until the container stopped or timeout
+// passed, a negative timeout waits forever
+func waitStopped(id string, timeout time.Duration) (*state.Container, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		c, err := store.Load(id)
+		if err != nil {
+			return nil, true
+		}
+		if stopped(c) {
+			return c, true
+		}
+		if timeout >= 0 && time.Now().After(deadline) {
+			return c, false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func signalContainer(c *state.Container, sig syscall.Signal) error {
+	if !c.Alive() {
+		return fmt.Errorf("container %s is not running", c.ID[:12])
+	}
+	if err := syscall.Kill(c.Pid, sig); err != nil {
+		return fmt.Errorf("signal %s: %w", unix.SignalName(sig), err)
+	}
+	return nil
+}
+
+// killContainer kills every process of c. Its cgroup catches the ones that
+// left the container's PID namespace, killing the init would miss them.
+func killContainer(c *state.Container) error {
+	if !c.Alive() || c.CgroupPath == "" {
+		return signalContainer(c, syscall.SIGKILL)
+	}
+	if err := cgroup.Kill(c.CgroupPath); err != nil {
+		log.Printf("warn: %v", err)
+		return signalContainer(c, syscall.SIGKILL)
+	}
+	return nil
+}
+
+// killTimeout is how long stop and rm -f wait for a killed container's exit
+// to be recorded
+const killTimeout = 10 * time.Second
+
+// killAndWait kills c and waits until it is recorded stopped, returning the
+// record then, nil if it is gone. A failed kill is only an error if the
+// container didn't exit anyway.
+func killAndWait(c *state.Container) (*state.Container, error) {
+	if err := killContainer(c); err != nil {
+		if c, ok := waitStopped(c.ID, time.Second); ok {
+			return c, nil
+		}
+		return nil, err
+	}
+	c, ok := waitStopped(c.ID, killTimeout)
+	if !ok {
+		return nil, fmt.Errorf("container %s did not exit within %v of SIGKILL", c.ID[:12], killTimeout)
+	}
+	return c, nil
+}
+
+// parseSignal accepts KILL, SIGKILL or 9
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	sig := unix.SignalNum("SIG" + strings.TrimPrefix(strings.ToUpper(s), "SIG"))
+	if sig == 0 {
+		return 0, fmt.Errorf("invalid signal %s", s)
+	}
+	return sig, nil
+}
+
+func psCmd(args []string) int {
+	flags := flag.NewFlagSet("ps", flag.ExitOnError)
+	all := flags.Bool("a", false, "show all containers (default: running only)")
+	flags.Parse(args)
+	openStore()
+
+	list, err := store.List()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER ID\tIMAGE\tCOMMAND\tCREATED\tSTATUS\tNAMES")
+	for _, c := range list {
+		if !*all && stopped(c) {
+			continue
+		}
+		cmd := strings.Join(c.Cmd, " ")
+		if len(cmd) > 20 {
+			cmd = cmd[:19] + "…"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%q\t%s ago\t%s\t%s\n", c.ID[:12], c.Image, cmd, humanDuration(time.Since(c.Created)), statusLine(c), c.Name)
+	}
+	w.Flush()
+	return 0
+}
+
+func statusLine(c *state.Container) string {
+	switch {
+	case c.Status == state.Created:
+		return "Created"
+	case c.Status == state.Running && stopped(c):
+		return "Exited (unknown)"
+	case c.Status == state.Running && c.Paused:
+		return "Up " + humanDuration(time.Since(c.Started)) + " (Paused)"
+	case c.Status == state.Running && c.Health != nil && c.Health.Status == health.Starting:
+		return "Up " + humanDuration(time.Since(c.Started)) + " (health: starting)"
+	case c.Status == state.Running && c.Health != nil:
+		return "Up " + humanDuration(time.Since(c.Started)) + " (" + c.Health.Status + ")"
+	case c.Status == state.Running:
+		return "Up " + humanDuration(time.Since(c.Started))
+	case c.Status == state.Restarting && !stopped(c):
+		return fmt.Sprintf("Restarting (%d) %s ago", c.ExitCode, humanDuration(time.Since(c.Finished)))
+	}
+	return fmt.Sprintf("Exited (%d) %s ago", c.ExitCode, humanDuration(time.Since(c.Finished)))
+}
+
+func humanDuration(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return "less than a second"
+	case d < time.Minute:
+		return fmt.Sprintf("%d seconds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%d minutes", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	}
+	return fmt.Sprintf("%d days", int(d.Hours()/24))
+}
+
+func inspectCmd(args []string) int {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	flags.Parse(args)
+	openStore()
+
+	out := []*state.Container{}
+	status := eachContainer(flags.Args(), func(c *state.Container) error {
+		out = append(out, c)
+		return nil
+	})
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		fatalf("%v", err)
+	}
+	fmt.Println(string(data))
+	return status
+}
+
+func stopCmd(args []string) int {
+	flags := flag.NewFlagSet("stop", flag.ExitOnError)
+	timeout := flags.Int("t", 10, "seconds to wait for the container to exit before killing it")
+	sigName := flags.String("s", "", "signal to send first, name or number (default: the container's stop signal)")
+	flags.Parse(args)
+	if *sigName != "" {
+		if _, err := parseSignal(*sigName); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	openStore()
+
+	return eachContainer(flags.Args(), func(c *state.Container) error {
+		if !stopped(c) {
+			if err := requestStop(c.ID); err != nil {
+				return err
+			}
+			sig := syscall.SIGTERM
+			if name := cmp.Or(*sigName, c.StopSignal); name != "" {
+				s, err := parseSignal(name)
+				if err != nil {
+					log.Printf("warn: %v, sending SIGTERM", err)
+				} else {
+					sig = s
+				}
+			}
+			// PID 1 ignores the signal unless it handles it, hence the kill.
+			// Without the signal there is nothing to wait for.
+			wait := time.Duration(*timeout) * time.Second
+			if err := signalContainer(c, sig); err != nil {
+				log.Printf("warn: %v", err)
+				wait = 0
+			}
+			if _, ok := waitStopped(c.ID, wait); !ok {
+				if _, err := killAndWait(c); err != nil {
+					return err
+				}
+			}
+		}
+		fmt.Println(c.Name)
+		return nil
+	})
+}
+
+func killCmd(args []string) int {
+	flags := flag.NewFlagSet("kill", flag.ExitOnError)
+	sigName := flags.String("s", "KILL", "signal to send, name or number")
+	flags.Parse(args)
+	sig, err := parseSignal(*sigName)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	openStore()
+
+	return eachContainer(flags.Args(), func(c *state.Container) error {
+		var err error
+		if sig == syscall.SIGKILL {
+			err = killContainer(c)
+		} else {
+			err = signalContainer(c, sig)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(c.Name)
+		return nil
+	})
+}
+
+func startCmd(args []string) int {
+	flags := flag.NewFlagSet("start", flag.ExitOnError)
+	flags.Parse(args)
+	openStore()
+
+	return eachContainer(flags.Args(), func(c *state.Container) error {
+		if !stopped(c) {
+			return fmt.Errorf("container %s is already running", c.ID[:12])
+		}
+		if err := spawnShim(c.ID, c.Args); err != nil {
+			return err
+		}
+		fmt.Println(c.Name)
+		return nil
+	})
+}
+
+func rmCmd(args []string) int {
+	flags := flag.NewFlagSet("rm", flag.ExitOnError)
+	force := flags.Bool("f", false, "kill a running container before removing it")
+	flags.Parse(args)
+	openStore()
+
+	return eachContainer(flags.Args(), func(c *state.Container) error {
+		if !stopped(c) {
+			if !*force {
+				return fmt.Errorf("container %s is running, stop it first or use -f", c.ID[:12])
+			}
+			if err := requestStop(c.ID); err != nil {
+				return err
+			}
+			var err error
+			if c, err = killAndWait(c); err != nil {
+				return err
+			}
+			if c == nil {
+				// it was run with -rm
+				return nil
+			}
+		}
+		// processes left in the cgroup keep the record and the layer, without
+		// them nothing would be left to kill them through
+		if c.CgroupPath != "" {
+			if err := cgroup.Remove(c.CgroupPath); err != nil {
+				return err
+			}
+		}
+		if c.Storage != "" {
+			driver, err := fs.NewStorageDriver(c.Storage, c.Options)
+			if err != nil {
+				return err
+			}
+			// only mounted if the runtime died with the container
+			driver.Unmount(c.ID, c.Rootfs)
+			if err := driver.Remove(c.ID); err != nil {
+				return err
+			}
+		}
+		if err := store.Remove(c.ID); err != nil {
+			return err
+		}
+		fmt.Println(c.Name)
+		return nil
+	})
+}
+
+func waitCmd(args []string) int {
+	flags := flag.NewFlagSet("wait", flag.ExitOnError)
+	flags.Parse(args)
+	openStore()
+
+	return eachContainer(flags.Args(), func(c *state.Container) error {
+		c, _ = waitStopped(c.ID, -1)
+		if c == nil {
+			return state.ErrNotFound
+		}
+		fmt.Println(c.ExitCode)
+		return nil
+	})
+}
+
+func execCmd(args []string) int {
+	flags := flag.NewFlagSet("exec", flag.ExitOnError)
+	interactive := flags.Bool("i", false, "keep stdin attached to the command")
+	tty := flags.Bool("t", false, "allocate a pseudo-terminal for the command")
+	both := flags.Bool("it", false, "same as -i -t")
+	user := flags.String("u", "", "user to run as: name|uid[:group|gid] (default: the container's)")
+	var env stringList
+	flags.Var(&env, "e", "environment variable K=V for the command, repeatable")
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		fatalf("usage: exec [-it] [-u user] [-e K=V] container command [args...]")
+	}
+	for _, e := range env {
+		if !strings.Contains(e, "=") {
+			fatalf("invalid environment variable %s, want K=V", e)
+		}
+	}
+	// no rootless namespace of our own: the container's user namespace can
+	// only be joined from its parent
+	store = state.Store{Root: state.DefaultRoot()}
+	c, err := store.Lookup(flags.Arg(0))
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if stopped(c) {
+		fatalf("container %s is not running", c.ID[:12])
+	}
+	if c.Paused {
+		fatalf("container %s is paused, unpause it first", c.ID[:12])
+	}
+
+	res, err := sandbox.Exec(sandbox.ExecConfig{
+		Pid:         c.Pid,
+		StateDir:    store.Dir(c.ID),
+		CgroupPath:  c.CgroupPath,
+		Args:        flags.Args()[1:],
+		User:        *user,
+		Env:         env,
+		TTY:         *tty || *both,
+		Interactive: *interactive || *both,
+	})
+	if err != nil {
+		fatalf("exec failed: %v", err)
+	}
+	return res.Status()
+}
+
+func logsCmd(args []string) int {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := flags.Bool("f", false, "keep printing new output until the container stops")
+	since := flags.String("since", "", "only output since a time (RFC 3339) or a duration ago (eg 10m)")
+	tail := flags.String("tail", "all", "number of lines to show from the end of the log, or all")
+	timestamps := flags.Bool("timestamps", false, "prefix each line with its time")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fatalf("usage: logs [-f] [-since time] [-tail n] [-timestamps] container")
+	}
+	opts := logs.ReadOptions{Tail: -1, Follow: *follow}
+	if *tail != "all" {
+		n, err := strconv.Atoi(*tail)
+		if err != nil || n < 0 {
+			fatalf("invalid tail %s", *tail)
+		}
+		opts.Tail = n
+	}
+	if *since != "" {
+		if t, err := time.Parse(time.RFC3339Nano, *since); err == nil {
+			opts.Since = t
+		} else if d, err := time.ParseDuration(*since); err == nil {
+			opts.Since = time.Now().Add(-d)
+		} else {
+			fatalf("invalid since %s, want a time or a duration", *since)
+		}
+	}
+	openStore()
+
+	c, err := store.Lookup(flags.Arg(0))
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if c.LogPath == "" {
+		fatalf("container %s has no log, only detached containers are logged", c.ID[:12])
+	}
+	opts.Stopped = func() bool {
+		c, err := store.Load(c.ID)
+		return err != nil || stopped(c)
+	}
+	err = logs.Read(c.LogPath, opts, func(e logs.Entry) error {
+		out := os.Stdout
+		if e.Stream == "stderr" {
+			out = os.Stderr
+		}
+		if *timestamps {
+			fmt.Fprint(out, e.Time.Format(time.RFC3339Nano), " ")
+		}
+		_, err := io.WriteString(out, e.Log)
+		return err
+	})
+	if err != nil {
+		fatalf("%v", err)
+	}
+	return 0
+}
+
+func attachCmd(args []string) int {
+	flags := flag.NewFlagSet("attach", flag.ExitOnError)
+	detachKeys := flags.String("detach-keys", "ctrl-p,ctrl-q", "key sequence that detaches from the container")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fatalf("usage: attach [-detach-keys keys] container")
+	}
+	keys, err := attach.ParseDetachKeys(*detachKeys)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	openStore()
+
+	c, err := store.Lookup(flags.Arg(0))
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if stopped(c) {
+		fatalf("container %s is not running", c.ID[:12])
+	}
+	if c.Paused {
+		fatalf("container %s is paused, unpause it first", c.ID[:12])
+	}
+	if c.LogPath == "" {
+		fatalf("container %s runs in the foreground of another runtime, only detached containers can be attached to", c.ID[:12])
+	}
+	client, err := attach.Dial(filepath.Join(store.Dir(c.ID), attachSocket))
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer client.Close()
+
+	if c.TTY && sandbox.IsTerminal(os.Stdin) {
+		restore, err := sandbox.MakeRaw(os.Stdin)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer restore()
+		resize := func() {
+			if ws, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ); err == nil {
+				client.Resize(ws.Row, ws.Col)
+			}
+		}
+		resize()
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGWINCH)
+		defer signal.Stop(sigs)
+		go func() {
+			for range sigs {
+				resize()
+			}
+		}()
+	}
+
+	detached := make(chan struct{})
+	go func() {
+		// the end of our stdin doesn't end the attachment, only the keys do
+		if err := client.Input(os.Stdin, keys); err == attach.ErrDetached {
+			close(detached)
+		}
+	}()
+	output := make(chan error, 1)
+	go func() { output <- client.Output(os.Stdout, os.Stderr) }()
+
+	select {
+	case <-detached:
+		return 0
+	case err := <-output:
+		if err != nil {
+			log.Printf("attach: %v", err)
+		}
+	}
+	// the shim hangs up once the container exited
+	if c, _ = waitStopped(c.ID, -1); c == nil {
+		return 0
+	}
+	return c.ExitCode
+}
+
+func pauseCmd(args []string) int {
+	flags := flag.NewFlagSet("pause", flag.ExitOnError)
+	flags.Parse(args)
+	openStore()
+
+	return eachContainer(flags.Args(), func(c *state.Container) error {
+		return setPaused(c, true)
+	})
+}
+
+func unpauseCmd(args []string) int {
+	flags := flag.NewFlagSet("unpause", flag.ExitOnError)
+	flags.Parse(args)
+	openStore()
+
+	return eachContainer(flags.Args(), func(c *state.Container) error {
+		return setPaused(c, false)
+	})
+}
+
+// setPaused freezes or thaws the cgroup of c. It happens under the record's
+// lock, so the record says what the freezer does.
+func setPaused(c *state.Container, paused bool) error {
+	if stopped(c) || c.Status != state.Running {
+		return fmt.Errorf("container %s is not running", c.ID[:12])
+	}
+	err := store.Update(c.ID, func(c *state.Container) error {
+		switch {
+		case c.CgroupPath == "":
+			return fmt.Errorf("container %s has no cgroup to freeze", c.ID[:12])
+		case c.Paused == paused && paused:
+			return fmt.Errorf("container %s is already paused", c.ID[:12])
+		case c.Paused == paused:
+			return fmt.Errorf("container %s is not paused", c.ID[:12])
+		}
+		freeze := cgroup.Thaw
+		if paused {
+			freeze = cgroup.Freeze
+		}
+		if err := freeze(c.CgroupPath); err != nil {
+			return err
+		}
+		c.Paused = paused
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(c.Name)
+	return nil
+}
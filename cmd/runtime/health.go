@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"myruntime/pkg/health"
+	"myruntime/pkg/state"
+)
+
+// healthMonitor probes a running container and records its health
+type healthMonitor struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startHealth starts probing container id, which just started
+func startHealth(id string, hc *health.Config) *healthMonitor {
+	m := &healthMonitor{stop: make(chan struct{}), done: make(chan struct{})}
+	started := time.Now()
+	record := func(r health.Result) {
+		err := store.Update(id, func(c *state.Container) error {
+			// exec refuses to enter a paused container
+			if c.Health != nil && !c.Paused {
+				c.Health.Record(r, hc, started)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("warn: %v", err)
+		}
+	}
+	go func() {
+		defer close(m.done)
+		health.Monitor(hc, probe(id), record, m.stop)
+	}()
+	return m
+}
+
+// Stop ends probing once the container exited
+func (m *healthMonitor) Stop() {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+}
+
+// probe runs health commands in container id through the exec command, so
+// they enter the container the way exec does
+func probe(id string) func(args []string, timeout time.Duration) health.Result {
+	return func(args []string, timeout time.Duration) health.Result {
+		r := health.Result{Start: time.Now()}
+		var out bytes.Buffer
+		cmd := exec.Command("/proc/self/exe", append([]string{"exec", id}, args...)...)
+		cmd.Stdout, cmd.Stderr = &out, &out
+		// a timeout kills the whole group, exec and the command with it
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if err := cmd.Start(); err != nil {
+			r.End, r.ExitCode, r.Output = time.Now(), 1, err.Error()
+			return r
+		}
+		timer := time.AfterFunc(timeout, func() {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		cmd.Wait()
+		r.End = time.Now()
+		r.Output = out.String()
+		r.ExitCode = cmd.ProcessState.ExitCode()
+		if !timer.Stop() {
+			r.ExitCode = -1
+			r.Output = fmt.Sprintf("health check exceeded timeout (%v)", timeout)
+		}
+		return r
+	}
+}
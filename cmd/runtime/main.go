@@ -3,58 +3,407 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"myruntime/pkg/attach"
 	"myruntime/pkg/cgroup"
 	"myruntime/pkg/fs"
+	"myruntime/pkg/health"
 	"myruntime/pkg/image"
+	"myruntime/pkg/logs"
 	"myruntime/pkg/netsetup"
 	"myruntime/pkg/sandbox"
+	"myruntime/pkg/seccomp"
+	"myruntime/pkg/state"
+	"myruntime/pkg/userns"
+
+	"golang.org/x/sys/unix"
 )
 
 func main() {
+	if filepath.Base(os.Args[0]) == ociName {
+		os.Exit(ociCmd(os.Args[1:]))
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "shim":
+			os.Exit(shimMain(os.Args[2:]))
+		case "run":
+			os.Exit(run(os.Args[2:], ""))
+		}
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+	os.Exit(run(os.Args[1:], ""))
+}
+
+// store holds the container records; containerID is the container run is
+// working on once it has a record, so fatalf can note the failure
+var (
+	store       state.Store
+	containerID string
+)
+
+// run runs a container as the command line says and returns the exit status.
+// id is set in the shim of a detached container, empty otherwise.
+func run(argv []string, id string) int {
 	imageName := flag.String("image", "busybox", "image to run (docker/oci)")
-	cmd := flag.String("cmd", "sh", "command to run inside container (quoted string)")
-	name := flag.String("name", "myctr", "container name")
+	cmd := flag.String("cmd", "sh", "command to run inside container, split on spaces; arguments after -- take precedence")
+	name := flag.String("name", "", "container name (default: the short container ID)")
 	cpu := flag.String("cpu", "", "cgroup v2 cpu.max (e.g. \"100000 100000\" or \"max\")")
 	memory := flag.String("memory", "", "cgroup v2 memory.max (e.g. \"100M\")")
-	capAdd := flag.String("cap-add", "", "comma-separated caps to add")
-	capDrop := flag.String("cap-drop", "", "comma-separated caps to drop")
+	capAdd := flag.String("cap-add", "", "comma-separated caps to add to the default set, ALL for every cap")
+	capDrop := flag.String("cap-drop", "", "comma-separated caps to drop from the default set, ALL for every cap")
 	publish := flag.String("publish", "", "comma-separated port mappings host:container (eg 8080:80,4443:443)")
 	bridge := flag.String("bridge", "myruntime0", "host bridge name to attach containers to")
 	networkCidr := flag.String("bridge-cidr", "172.25.0.0/16", "CIDR for bridge network")
-	flag.Parse()
+	readOnly := flag.Bool("read-only", false, "mount the container rootfs read-only")
+	storageSize := flag.String("storage-size", "", "limit the container writable layer (eg 10G)")
+	storageDriver := flag.String("storage-driver", "", "rootfs storage driver: overlay, vfs or btrfs (default: detect)")
+	hostname := flag.String("hostname", "", "container hostname (default: container name)")
+	var dns, dnsSearch, addHost stringList
+	flag.Var(&dns, "dns", "DNS server for the container, repeatable")
+	flag.Var(&dnsSearch, "dns-search", "DNS search domain for the container, repeatable")
+	flag.Var(&addHost, "add-host", "extra /etc/hosts entry host:ip, repeatable")
+	usernsMode := flag.String("userns", "", "user namespace: \"auto\" to allocate from /etc/subuid and /etc/subgid, \"host\" for none")
+	uidMap := flag.String("uidmap", "", "uid map container:host:size[,...] (implies a user namespace)")
+	gidMap := flag.String("gidmap", "", "gid map container:host:size[,...] (default: same as -uidmap)")
+	var securityOpts stringList
+	flag.Var(&securityOpts, "security-opt", "security option: seccomp=<profile.json>, seccomp=unconfined or no-new-privileges, repeatable")
+	var ulimits stringList
+	flag.Var(&ulimits, "ulimit", "resource limit name=soft[:hard] (eg nofile=1024:2048), repeatable")
+	oomScoreAdj := flag.String("oom-score-adj", "", "oom_score_adj of the container process, -1000 to 1000")
+	user := flag.String("user", "", "user to run as: name|uid[:group|gid], resolved in the image (default: root)")
+	var groupAdd stringList
+	flag.Var(&groupAdd, "group-add", "additional group for the container process, name or gid, repeatable")
+	tty := flag.Bool("t", false, "allocate a pseudo-terminal for the container")
+	interactive := flag.Bool("i", false, "keep stdin attached to the container")
+	initProc := flag.Bool("init", false, "run a minimal init as PID 1 that reaps zombies and forwards signals")
+	detach := flag.Bool("d", false, "run the container in the background and print its ID")
+	autoRemove := flag.Bool("rm", false, "remove the container and its writable layer when it exits")
+	restart := flag.String("restart", "no", "restart policy: no, on-failure[:max-retries], always or unless-stopped")
+	var logOpts stringList
+	flag.Var(&logOpts, "log-opt", "log option of detached containers: max-size=<size> or max-file=<n>, repeatable")
+	healthCmd := flag.String("health-cmd", "", "command run with /bin/sh -c in the container to check its health (default: the image's)")
+	healthInterval := flag.Duration("health-interval", 0, "time between health checks (default: the image's, or 30s)")
+	healthTimeout := flag.Duration("health-timeout", 0, "time a health check may take (default: the image's, or 30s)")
+	healthRetries := flag.Int("health-retries", 0, "failed health checks in a row that make the container unhealthy (default: the image's, or 3)")
+	healthStartPeriod := flag.Duration("health-start-period", 0, "time after start in which failed health checks don't count (default: the image's)")
+	noHealthcheck := flag.Bool("no-healthcheck", false, "disable the image's healthcheck")
+	stopSignal := flag.String("stop-signal", "", "signal stop sends the container first, name or number (default: the image's, or SIGTERM)")
+	var tmpfs stringList
+	flag.Var(&tmpfs, "tmpfs", "tmpfs mount /path[:opts] (eg /tmp:size=64m,mode=1777), repeatable")
+	flag.CommandLine.Parse(argv)
 
-	workRoot := filepath.Join(os.TempDir(), "myruntime", *name)
-	lower := filepath.Join(workRoot, "lower")
-	mount := filepath.Join(workRoot, "rootfs")
-	upper := filepath.Join(workRoot, "upper")
-	workDir := filepath.Join(workRoot, "work")
+	args := flag.Args()
+	if len(args) == 0 {
+		args = strings.Fields(*cmd)
+	}
+
+	shim := id != ""
+	// unprivileged users get a user namespace where they are root; a shim
+	// is already in it
+	if !shim && (os.Geteuid() != 0 || userns.Rootless()) {
+		if err := userns.EnterRootless(); err != nil {
+			fatalf("rootless setup failed: %v", err)
+		}
+	}
+
+	store = state.Store{Root: state.DefaultRoot()}
+	var c *state.Container
+	if shim {
+		var err error
+		if c, err = store.Load(id); err != nil {
+			fatalf("%v", err)
+		}
+		containerID = id
+		*name = c.Name
+	}
 
-	log.Printf("pulling image %s\n", *imageName)
-	if err := image.ExportRootFS(*imageName, lower); err != nil {
-		log.Fatalf("image export failed: %v", err)
+	if _, err := sandbox.ResolveCaps(*capAdd, *capDrop); err != nil {
+		fatalf("%v", err)
+	}
+	for _, t := range tmpfs {
+		if _, err := fs.ParseTmpfs(t); err != nil {
+			fatalf("invalid tmpfs %s: %v", t, err)
+		}
 	}
 
-	log.Printf("mounting overlayfs\n")
-	if err := fs.MountOverlay(lower, upper, workDir, mount); err != nil {
-		log.Fatalf("overlay mount failed: %v", err)
+	for _, h := range addHost {
+		if _, _, err := netsetup.ParseExtraHost(h); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	for _, d := range dns {
+		if net.ParseIP(d) == nil {
+			fatalf("invalid dns server %s", d)
+		}
 	}
 
-	cgPath := ""
-	if *cpu != "" || *memory != "" {
+	var uids, gids []userns.IDMap
+	switch {
+	case *uidMap != "" || *gidMap != "":
 		var err error
-		cgPath, err = cgroup.CreateCG(*name, *cpu, *memory)
+		if uids, err = userns.ParseIDMap(*uidMap); err != nil {
+			fatalf("invalid uidmap: %v", err)
+		}
+		gids = uids
+		if *gidMap != "" {
+			if gids, err = userns.ParseIDMap(*gidMap); err != nil {
+				fatalf("invalid gidmap: %v", err)
+			}
+		}
+	case *usernsMode == "auto":
+		// allocated when the container is recorded, from what others hold
+	case *usernsMode == "" || *usernsMode == "host":
+	default:
+		fatalf("invalid userns mode %q", *usernsMode)
+	}
+	// a restarted container keeps the maps its layer was shifted to, a shim
+	// the ones allocated for it
+	if c != nil && (c.Storage != "" || c.UIDMap != nil) {
+		uids, gids = c.UIDMap, c.GIDMap
+	}
+	if userns.Rootless() {
+		if uids != nil || *usernsMode == "auto" {
+			fatalf("-userns and id maps need root; rootless mode already maps container root to uid %d", userns.RootlessUID())
+		}
+		if *publish != "" {
+			fatalf("-publish is not supported in rootless mode")
+		}
+	}
+
+	logOptions, err := logs.ParseOptions(logOpts)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	policy, err := state.ParseRestartPolicy(*restart)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *autoRemove && policy.Name != state.RestartNo {
+		fatalf("-rm and -restart %s conflict", policy)
+	}
+	if *stopSignal != "" {
+		if _, err := parseSignal(*stopSignal); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	if *healthInterval < 0 || *healthTimeout < 0 || *healthStartPeriod < 0 || *healthRetries < 0 {
+		fatalf("health check intervals, timeouts and retries can't be negative")
+	}
+	healthOverride := health.Config{
+		Interval:    *healthInterval,
+		Timeout:     *healthTimeout,
+		StartPeriod: *healthStartPeriod,
+		Retries:     *healthRetries,
+	}
+	if *healthCmd != "" {
+		healthOverride.Test = []string{"CMD-SHELL", *healthCmd}
+	}
+
+	var limits []sandbox.Ulimit
+	for _, u := range ulimits {
+		l, err := sandbox.ParseUlimit(u)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		limits = append(limits, l)
+	}
+	var oomAdj *int
+	if *oomScoreAdj != "" {
+		n, err := strconv.Atoi(*oomScoreAdj)
+		if err != nil || n < -1000 || n > 1000 {
+			fatalf("invalid oom-score-adj %s, want -1000 to 1000", *oomScoreAdj)
+		}
+		oomAdj = &n
+	}
+
+	profile := seccomp.DefaultProfile()
+	noNewPrivs := false
+	for _, opt := range securityOpts {
+		key, val, _ := strings.Cut(opt, "=")
+		switch key {
+		case "seccomp":
+			if val == "unconfined" {
+				profile = nil
+				continue
+			}
+			p, err := seccomp.LoadProfile(val)
+			if err != nil {
+				fatalf("%v", err)
+			}
+			// catch compile errors before anything is set up
+			if _, err := seccomp.Compile(p, nil); err != nil {
+				fatalf("%v", err)
+			}
+			profile = p
+		case "no-new-privileges":
+			noNewPrivs = true
+			if val != "" {
+				b, err := strconv.ParseBool(val)
+				if err != nil {
+					fatalf("invalid security-opt %s", opt)
+				}
+				noNewPrivs = b
+			}
+		default:
+			fatalf("unknown security-opt %s", opt)
+		}
+	}
+
+	if !shim {
+		id = newID()
+		if *name == "" {
+			*name = id[:12]
+		}
+		c = &state.Container{
+			ID:          id,
+			Name:        *name,
+			Image:       *imageName,
+			Args:        argv,
+			Cmd:         args,
+			TTY:         *tty,
+			Interactive: *interactive,
+			Restart:     policy,
+			Status:      state.Created,
+			Created:     time.Now(),
+		}
+		err := store.CreateWith(c, func(c *state.Container, others []*state.Container) error {
+			if *usernsMode != "auto" || uids != nil {
+				return nil
+			}
+			var takenUIDs, takenGIDs []userns.IDMap
+			for _, o := range others {
+				takenUIDs = append(takenUIDs, o.UIDMap...)
+				takenGIDs = append(takenGIDs, o.GIDMap...)
+			}
+			var err error
+			if uids, gids, err = userns.Auto(userns.DefaultSize, takenUIDs, takenGIDs); err != nil {
+				return fmt.Errorf("userns auto: %w", err)
+			}
+			c.UIDMap, c.GIDMap = uids, gids
+			return nil
+		})
+		if err != nil {
+			fatalf("%v", err)
+		}
+		containerID = id
+		if *detach {
+			return startShim(id, argv)
+		}
+	}
+
+	storageRoot := filepath.Join(os.TempDir(), "myruntime")
+	if userns.Rootless() {
+		storageRoot = filepath.Join(os.TempDir(), fmt.Sprintf("myruntime-%d", userns.RootlessUID()))
+	}
+	workRoot := filepath.Join(storageRoot, id)
+	lower := filepath.Join(workRoot, "lower")
+	mount := filepath.Join(workRoot, "rootfs")
+
+	storageOpts := fs.StorageOptions{Root: storageRoot}
+	if uids != nil {
+		storageOpts.RootUID, _ = userns.HostID(uids, 0)
+		storageOpts.RootGID, _ = userns.HostID(gids, 0)
+	}
+	if *storageSize != "" {
+		size, err := fs.ParseSize(*storageSize)
+		if err != nil {
+			fatalf("invalid storage-size: %v", err)
+		}
+		storageOpts.Size = size
+	}
+	// a started container reuses the layer it was created with
+	fresh := c.Storage == ""
+	if !fresh {
+		*storageDriver = c.Storage
+		storageOpts = c.Options
+	}
+	driver, err := fs.NewStorageDriver(*storageDriver, storageOpts)
+	if err != nil {
+		fatalf("storage driver: %v", err)
+	}
+
+	digest, healthcheck, stopSig, quota := c.ImageDigest, c.Healthcheck, c.StopSignal, c.QuotaBackend
+	if fresh {
+		log.Printf("pulling image %s\n", *imageName)
+		info, err := image.ExportRootFS(*imageName, lower)
 		if err != nil {
-			log.Fatalf("cgroup create failed: %v", err)
+			fatalf("image export failed: %v", err)
+		}
+		digest = info.Digest
+		healthcheck = health.Merge(info.Healthcheck, healthOverride)
+		if *noHealthcheck {
+			healthcheck = nil
+		}
+		stopSig = *stopSignal
+		if stopSig == "" {
+			stopSig = info.StopSignal
+		}
+		if uids != nil {
+			log.Printf("shifting image ownership into the user namespace\n")
+			if err := userns.ShiftOwnership(lower, uids, gids); err != nil {
+				fatalf("%v", err)
+			}
+		}
+
+		log.Printf("preparing rootfs\n")
+		if quota, err = driver.Prepare(id, lower); err != nil {
+			fatalf("storage prepare failed: %v", err)
+		}
+		if quota != "" {
+			log.Printf("writable layer limited to %d bytes using %s\n", storageOpts.Size, quota)
 		}
+	}
+	if err := driver.Mount(id, mount); err != nil {
+		fatalf("rootfs mount failed: %v", err)
+	}
+	log.Printf("storage driver: %s\n", driver.Name())
+
+	// every container gets a cgroup, pause freezes it
+	cgPath, err := cgroup.CreateCG(*name, *cpu, *memory)
+	switch {
+	case err != nil && userns.Rootless() && *cpu == "" && *memory == "":
+		// without a delegated cgroup a rootless container stays in ours
+		log.Printf("warn: no cgroup for the container: %v", err)
+	case err != nil:
+		fatalf("cgroup create failed: %v", err)
+	default:
 		log.Printf("created cgroup: %s\n", cgPath)
 	}
 
+	err = store.Update(id, func(c *state.Container) error {
+		c.ImageDigest = digest
+		c.Healthcheck = healthcheck
+		c.StopSignal = stopSig
+		c.Storage = driver.Name()
+		c.Options = storageOpts
+		c.QuotaBackend = quota
+		c.UIDMap, c.GIDMap = uids, gids
+		c.Rootfs = mount
+		c.CgroupPath = cgPath
+		// counted from every start, and a stop before it no longer applies
+		c.RestartCount = 0
+		c.StopRequested = false
+		if shim {
+			c.LogPath = filepath.Join(store.Dir(id), logFile)
+		}
+		return nil
+	})
+	if err != nil {
+		fatalf("%v", err)
+	}
+
 	// Parse publish rules
 	pubs := []netsetup.PortMap{}
 	if *publish != "" {
@@ -66,40 +415,290 @@ func main() {
 			}
 			hostPort, contPort, err := netsetup.ParsePortMap(m)
 			if err != nil {
-				log.Fatalf("invalid publish mapping %s: %v", m, err)
+				fatalf("invalid publish mapping %s: %v", m, err)
 			}
 			pubs = append(pubs, netsetup.PortMap{HostPort: hostPort, ContainerPort: contPort})
 		}
 	}
 
+	// a shim logs the container's output in the container's dir and serves
+	// its stdio to attach clients
+	var stdin, stdout, stderr *os.File
+	var resize chan sandbox.WindowSize
+	var logging sync.WaitGroup
+	var attached *attach.Server
+	if shim {
+		lw, err := logs.NewWriter(filepath.Join(store.Dir(id), logFile), logOptions)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer lw.Close()
+		var input io.Writer
+		if *interactive {
+			r, w, err := os.Pipe()
+			if err != nil {
+				fatalf("%v", err)
+			}
+			stdin, input = r, w
+		}
+		var onResize func(rows, cols uint16)
+		if *tty {
+			resize = make(chan sandbox.WindowSize, 16)
+			onResize = func(rows, cols uint16) {
+				select {
+				case resize <- sandbox.WindowSize{Rows: rows, Cols: cols}:
+				default:
+				}
+			}
+		}
+		if attached, err = attach.Listen(filepath.Join(store.Dir(id), attachSocket), input, onResize); err != nil {
+			fatalf("%v", err)
+		}
+		stdout = logStream(lw, attached.Output(attach.Stdout), "stdout", &logging)
+		stderr = logStream(lw, attached.Output(attach.Stderr), "stderr", &logging)
+	}
+
 	// Prepare sandbox configuration
 	cfg := sandbox.Config{
-		Name:         *name,
-		Rootfs:       mount,
-		Cmd:          cmd,
-		CgroupPath:   cgPath,
-		CapAdd:       capAdd,
-		CapDrop:      capDrop,
-		Publish:      pubs,
-		BridgeName:   bridge,
-		BridgeCIDR:   networkCidr,
-		WorkDir:      workRoot,
-		OverlayLower: lower,
-		OverlayUpper: upper,
-		OverlayWork:  workDir,
-	}
-
-	// Create bridge if needed
-	if err := netsetup.EnsureBridge(*cfg.BridgeName, *cfg.BridgeCIDR); err != nil {
-		log.Fatalf("bridge setup failed: %v", err)
+		Name:        *name,
+		Rootfs:      mount,
+		Args:        args,
+		CgroupPath:  cgPath,
+		CapAdd:      capAdd,
+		CapDrop:     capDrop,
+		Publish:     pubs,
+		BridgeName:  bridge,
+		BridgeCIDR:  networkCidr,
+		WorkDir:     workRoot,
+		Storage:     driver.Name(),
+		ReadOnly:    *readOnly,
+		Tmpfs:       tmpfs,
+		Devices:     true,
+		Seccomp:     profile,
+		NoNewPrivs:  noNewPrivs,
+		Ulimits:     limits,
+		OOMScoreAdj: oomAdj,
+		User:        *user,
+		GroupAdd:    groupAdd,
+		Init:        *initProc,
+		TTY:         *tty,
+		Interactive: *interactive,
+		Stdin:       stdin,
+		Stdout:      stdout,
+		Stderr:      stderr,
+		Resize:      resize,
+		UIDMap:      uids,
+		GIDMap:      gids,
+		StateDir:    store.Dir(id),
+		Etc: netsetup.DNSConfig{
+			Hostname:   *hostname,
+			DNS:        dns,
+			DNSSearch:  dnsSearch,
+			ExtraHosts: addHost,
+		},
+	}
+
+	var monitor *healthMonitor
+	cfg.OnStart = func(pid int, ips []string) {
+		err := store.Update(id, func(c *state.Container) error {
+			c.Status = state.Running
+			c.Pid = pid
+			c.ShimPid = os.Getpid()
+			c.IPs = ips
+			c.Started = time.Now()
+			c.Finished = time.Time{}
+			c.ExitCode, c.OOMKilled, c.Error = 0, false, ""
+			c.Paused = false
+			c.Health = nil
+			if healthcheck != nil {
+				c.Health = &health.State{Status: health.Starting}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("warn: %v", err)
+		}
+		if healthcheck != nil {
+			monitor = startHealth(id, healthcheck)
+		}
+		shimStarted()
+	}
+
+	// Create bridge if needed; a rootless runtime can't touch host networking
+	if !userns.Rootless() {
+		if err := netsetup.EnsureBridge(*cfg.BridgeName, *cfg.BridgeCIDR); err != nil {
+			fatalf("bridge setup failed: %v", err)
+		}
 	}
 	log.Printf("running sandbox\n")
-	if err := sandbox.Run(cfg); err != nil {
-		log.Fatalf("run failed: %v", err)
+	var res sandbox.Result
+	var exitCode int
+	delay := minRestartDelay
+	for restarts := 0; ; restarts++ {
+		res, err = sandbox.Run(cfg)
+		monitor.Stop()
+		monitor = nil
+		exitCode = res.Status()
+		if err != nil {
+			log.Printf("run failed: %v", err)
+			shimFailed(fmt.Sprintf("run failed: %v", err))
+			exitCode = sandbox.ExitRuntimeError
+			// a container that can't be set up won't be by retrying
+			break
+		}
+		fmt.Println("container exited")
+		switch {
+		case res.OOMKilled:
+			log.Printf("container was killed by the OOM killer after %v", res.Duration.Round(time.Millisecond))
+		case res.Signal != 0:
+			log.Printf("container was killed by %s after %v", unix.SignalName(res.Signal), res.Duration.Round(time.Millisecond))
+		}
+
+		if !policy.ShouldRestart(exitCode, restarts, stopRequested(id)) {
+			break
+		}
+		// a container that ran for a while isn't crash-looping
+		if res.Duration >= resetRestartDelay {
+			delay = minRestartDelay
+		}
+		uerr := store.Update(id, func(c *state.Container) error {
+			c.Status = state.Restarting
+			c.Paused = false
+			c.Pid = 0
+			c.ExitCode = exitCode
+			c.OOMKilled = res.OOMKilled
+			c.Finished = time.Now()
+			c.RestartCount = restarts + 1
+			return nil
+		})
+		if uerr != nil {
+			log.Printf("warn: %v", uerr)
+		}
+		log.Printf("restarting in %v (restart policy %s)", delay, policy)
+		if !waitRestart(id, delay) {
+			break
+		}
+		delay = min(2*delay, maxRestartDelay)
+
+		// a fresh cgroup, so limits and OOM kills start over
+		if cgPath != "" {
+			if err := cgroup.Remove(cgPath); err != nil {
+				log.Printf("warn: %v", err)
+			}
+			if cgPath, err = cgroup.CreateCG(*name, *cpu, *memory); err != nil {
+				exitCode = sandbox.ExitRuntimeError
+				log.Printf("cgroup create failed: %v", err)
+				break
+			}
+			cfg.CgroupPath = cgPath
+			uerr := store.Update(id, func(c *state.Container) error {
+				c.CgroupPath = cgPath
+				return nil
+			})
+			if uerr != nil {
+				log.Printf("warn: %v", uerr)
+			}
+		}
 	}
 
-	fmt.Println("container exited")
+	// everything is logged before anyone following the log sees the exit
+	if shim {
+		stdout.Close()
+		stderr.Close()
+		logging.Wait()
+		attached.Close()
+	}
+
+	uerr := store.Update(id, func(c *state.Container) error {
+		c.Status = state.Exited
+		c.Paused = false
+		c.Pid = 0
+		c.ExitCode = exitCode
+		c.OOMKilled = res.OOMKilled
+		c.Finished = time.Now()
+		if err != nil {
+			c.Error = err.Error()
+		}
+		return nil
+	})
+	if uerr != nil {
+		log.Printf("warn: %v", uerr)
+	}
+
+	// attempt cleanup, the layer stays for start unless -rm
+	if err := driver.Unmount(id, mount); err != nil {
+		log.Printf("warn: %v", err)
+	}
+	if cgPath != "" {
+		if err := cgroup.Remove(cgPath); err != nil {
+			log.Printf("warn: %v", err)
+		}
+	}
+	if *autoRemove {
+		if err := driver.Remove(id); err != nil {
+			log.Printf("warn: %v", err)
+		}
+		if err := store.Remove(id); err != nil {
+			log.Printf("warn: %v", err)
+		}
+	}
+	return exitCode
+}
+
+// restart backoff: the delay doubles with every restart up to the maximum,
+// and starts over once the container stayed up for resetRestartDelay
+const (
+	minRestartDelay   = 100 * time.Millisecond
+	maxRestartDelay   = time.Minute
+	resetRestartDelay = 10 * time.Second
+)
+
+// stopRequested reports whether stop was run on container id
+func stopRequested(id string) bool {
+	c, err := store.Load(id)
+	return err != nil || c.StopRequested
+}
+
+// waitRestart sleeps for delay before a restart and reports whether the
+// container should still be restarted, stop cuts it short
+func waitRestart(id string, delay time.Duration) bool {
+	deadline := time.Now().Add(delay)
+	for time.Now().Before(deadline) {
+		if stopRequested(id) {
+			return false
+		}
+		time.Sleep(min(100*time.Millisecond, time.Until(deadline)))
+	}
+	return !stopRequested(id)
+}
+
+// fatalf logs and exits with the runtime error status, which scripts can tell
+// apart from the container's own exit codes
+func fatalf(format string, v ...any) {
+	msg := fmt.Sprintf(format, v...)
+	log.Print(msg)
+	shimFailed(msg)
+	if containerID != "" {
+		// the container never ran, keep why
+		store.Update(containerID, func(c *state.Container) error {
+			c.Status = state.Exited
+			c.ExitCode = sandbox.ExitRuntimeError
+			c.Error = msg
+			c.Finished = time.Now()
+			return nil
+		})
+	}
+	os.Exit(sandbox.ExitRuntimeError)
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
 
-	// attempt cleanup
-	exec.Command("/bin/sh", "-c", fmt.Sprintf("umount %s || true && rm -rf %s || true", mount, workRoot)).Run()
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
 }
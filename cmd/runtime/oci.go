@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"myruntime/pkg/cgroup"
+	"myruntime/pkg/oci"
+	"myruntime/pkg/sandbox"
+	"myruntime/pkg/state"
+
+	"golang.org/x/sys/unix"
+)
+
+// The oci command is the runc command line over OCI bundles, so the runtime
+// can sit behind containerd and the like: "oci create" sets the container
+// up from the bundle's config.json and leaves it waiting, "oci start" runs
+// its process. The container's shim is its parent throughout.
+
+// Files of an OCI container in its state dir: the spec it was created
+// with, and the FIFO its init waits at until start opens it
+const (
+	specFile = "spec.json"
+	execFifo = "exec.fifo"
+)
+
+// ociName is the name the runtime takes the runc command line under
+// without the oci subcommand, as a link to it say
+const ociName = "myruntime-oci"
+
+// validID is what runc accepts as a container ID
+var validID = regexp.MustCompile(`^[\w+.-]+$`)
+
+var ociCommands = map[string]func(args []string, systemdCgroup bool) int{
+	"create": ociCreate,
+	"start":  ociStart,
+	"state":  ociState,
+	"kill":   ociKill,
+	"delete": ociDelete,
+}
+
+func ociCmd(args []string) int {
+	flags := flag.NewFlagSet("oci", flag.ExitOnError)
+	root := flags.String("root", state.DefaultRoot()+"-oci", "directory the state of OCI containers is kept in")
+	logPath := flags.String("log", "", "file to log to (default: stderr)")
+	logFormat := flags.String("log-format", "text", "log format: text or json")
+	systemdCgroup := flags.Bool("systemd-cgroup", false, "cgroupsPath is slice:prefix:name for systemd (not supported)")
+	flags.Parse(args)
+
+	if *logPath != "" {
+		f, err := os.OpenFile(*logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		log.SetOutput(f)
+	}
+	switch *logFormat {
+	case "text":
+	case "json":
+		log.SetFlags(0)
+		log.SetOutput(jsonLog{log.Writer()})
+	default:
+		fatalf("invalid log-format %s", *logFormat)
+	}
+
+	cmd, ok := ociCommands[flags.Arg(0)]
+	if !ok {
+		fatalf("usage: oci [flags] create|start|state|kill|delete [flags] <id>")
+	}
+	store = state.Store{Root: *root}
+	return cmd(flags.Args()[1:], *systemdCgroup)
+}
+
+// jsonLog writes each log line as the JSON object runc's json log format
+// has, which is how containerd finds a runtime's error
+type jsonLog struct {
+	w io.Writer
+}
+
+func (l jsonLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	level := "error"
+	if rest, ok := strings.CutPrefix(msg, "warn: "); ok {
+		level, msg = "warning", rest
+	}
+	line, err := json.Marshal(map[string]string{
+		"level": level,
+		"msg":   msg,
+		"time":  time.Now().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ociID returns the single container ID a subcommand takes
+func ociID(flags *flag.FlagSet, usage string) string {
+	if flags.NArg() < 1 {
+		fatalf("usage: oci %s", usage)
+	}
+	id := flags.Arg(0)
+	if !validID.MatchString(id) || id == "." || id == ".." {
+		fatalf("invalid container ID %q", id)
+	}
+	return id
+}
+
+func ociCreate(args []string, systemdCgroup bool) int {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	bundle := flags.String("bundle", ".", "path to the bundle")
+	flags.StringVar(bundle, "b", ".", "short for -bundle")
+	consoleSocket := flags.String("console-socket", "", "unix socket the master of the container's terminal is sent to")
+	pidFile := flags.String("pid-file", "", "file to write the container's pid to")
+	flags.Bool("no-pivot", false, "accepted for compatibility, the root is always entered with chroot")
+	flags.Bool("no-new-keyring", false, "accepted for compatibility, no session keyring is created")
+	flags.Parse(args)
+	id := ociID(flags, "create [flags] <id>")
+
+	dir, err := filepath.Abs(*bundle)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	spec, err := oci.LoadSpec(dir)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if spec.Process.Terminal != (*consoleSocket != "") {
+		fatalf("process.terminal needs -console-socket, and -console-socket needs process.terminal")
+	}
+	if *consoleSocket != "" {
+		if *consoleSocket, err = filepath.Abs(*consoleSocket); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	// the mapping is checked before anything is set up
+	if _, err := spec.Config(id, dir); err != nil {
+		fatalf("%v", err)
+	}
+	cgPath, err := spec.CgroupPath(id, systemdCgroup)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if _, err := store.Load(id); err == nil {
+		fatalf("container %s already exists", id)
+	}
+
+	rootfs := spec.Root.Path
+	if !filepath.IsAbs(rootfs) {
+		rootfs = filepath.Join(dir, rootfs)
+	}
+	c := &state.Container{
+		ID:          id,
+		Name:        id,
+		Cmd:         spec.Process.Args,
+		TTY:         spec.Process.Terminal,
+		Rootfs:      rootfs,
+		Bundle:      dir,
+		Annotations: spec.Annotations,
+		Status:      state.Created,
+		Created:     time.Now(),
+	}
+	if err := store.Create(c); err != nil {
+		fatalf("%v", err)
+	}
+	// nothing is left of a container that couldn't be created
+	abort := func(err error) {
+		cgroup.Remove(cgPath)
+		store.Remove(id)
+		fatalf("%v", err)
+	}
+	data, err := json.Marshal(spec)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(store.Dir(id), specFile), data, 0600)
+	}
+	if err != nil {
+		abort(err)
+	}
+	if err := cgroup.Create(cgPath, spec.CgroupLimits()); err != nil {
+		abort(err)
+	}
+	err = store.Update(id, func(c *state.Container) error {
+		c.CgroupPath = cgPath
+		return nil
+	})
+	if err != nil {
+		abort(err)
+	}
+	// the init may run as any user, it only ever writes to the FIFO
+	fifo := filepath.Join(store.Dir(id), execFifo)
+	if err := unix.Mkfifo(fifo, 0622); err != nil {
+		abort(fmt.Errorf("creating %s: %w", execFifo, err))
+	}
+	if err := os.Chmod(fifo, 0622); err != nil {
+		abort(err)
+	}
+
+	argv := []string{"oci", "-root", store.Root, "-console-socket", *consoleSocket}
+	if err := spawnShim(id, argv, os.Stdin, os.Stdout, os.Stderr); err != nil {
+		abort(err)
+	}
+	if *pidFile != "" {
+		c, err := store.Load(id)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		// written whole, whoever waits for it never reads half a pid
+		tmp := *pidFile + ".tmp"
+		if err := os.WriteFile(tmp, []byte(strconv.Itoa(c.Pid)), 0644); err != nil {
+			fatalf("%v", err)
+		}
+		if err := os.Rename(tmp, *pidFile); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	return 0
+}
+
+// ociShim supervises an OCI container: it sets the container up behind the
+// gate, runs the create hooks once it waits there and records its exit
+func ociShim(id string, args []string) int {
+	flags := flag.NewFlagSet("shim", flag.ExitOnError)
+	root := flags.String("root", "", "state directory")
+	consoleSocket := flags.String("console-socket", "", "console socket")
+	flags.Parse(args)
+	store = state.Store{Root: *root}
+
+	// the container is creating for as long as the shim sets it up
+	var c *state.Container
+	err := store.Update(id, func(rec *state.Container) error {
+		rec.ShimPid = os.Getpid()
+		c = rec
+		return nil
+	})
+	if err != nil {
+		fatalf("%v", err)
+	}
+	spec, err := loadSpec(id)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	cfg, err := spec.Config(id, c.Bundle)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	hooks := spec.Hooks
+	if hooks == nil {
+		hooks = &oci.Hooks{}
+	}
+	cfg.CgroupPath = c.CgroupPath
+	cfg.ConsoleSocket = *consoleSocket
+	cfg.Stdin = os.NewFile(4, "stdin")
+	cfg.Stdout = os.NewFile(5, "stdout")
+	cfg.Stderr = os.NewFile(6, "stderr")
+	cfg.Gate = filepath.Join(store.Dir(id), execFifo)
+	cfg.OnCreated = func(pid int) error {
+		err := store.Update(id, func(c *state.Container) error {
+			c.Pid = pid
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		c.Pid = pid
+		st := ociStateOf(c, oci.Created)
+		if err := oci.RunHooks("prestart", hooks.Prestart, st); err != nil {
+			return err
+		}
+		if err := oci.RunHooks("createRuntime", hooks.CreateRuntime, st); err != nil {
+			return err
+		}
+		shimStarted()
+		return nil
+	}
+	cfg.OnStart = func(pid int, ips []string) {
+		markRunning(id)
+	}
+
+	res, err := sandbox.Run(cfg)
+	exitCode := res.Status()
+	if err != nil {
+		log.Printf("run failed: %v", err)
+		shimFailed(err.Error())
+		exitCode = sandbox.ExitRuntimeError
+	}
+	uerr := store.Update(id, func(c *state.Container) error {
+		c.Status = state.Exited
+		c.Pid = 0
+		c.ExitCode = exitCode
+		c.OOMKilled = res.OOMKilled
+		c.Finished = time.Now()
+		if err != nil {
+			c.Error = err.Error()
+		}
+		return nil
+	})
+	if uerr != nil {
+		log.Printf("warn: %v", uerr)
+	}
+	// kills whatever the container left behind, delete removes it again
+	if err := cgroup.Remove(c.CgroupPath); err != nil {
+		log.Printf("warn: %v", err)
+	}
+	return exitCode
+}
+
+// markRunning records that created container id was started, unless it
+// already exited
+func markRunning(id string) {
+	err := store.Update(id, func(c *state.Container) error {
+		if c.Status == state.Created {
+			c.Status = state.Running
+			c.Started = time.Now()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("warn: %v", err)
+	}
+}
+
+func loadSpec(id string) (*oci.Spec, error) {
+	data, err := os.ReadFile(filepath.Join(store.Dir(id), specFile))
+	if err != nil {
+		return nil, err
+	}
+	var s oci.Spec
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("reading spec of %s: %w", id, err)
+	}
+	return &s, nil
+}
+
+// processAlive reports whether process pid exists
+func processAlive(pid int) bool {
+	return pid > 0 && syscall.Kill(pid, 0) != syscall.ESRCH
+}
+
+// ociStatus is the runtime-spec status of c
+func ociStatus(c *state.Container) string {
+	switch {
+	case c.Status == state.Created && c.Pid == 0 && processAlive(c.ShimPid):
+		return oci.Creating
+	case c.Status == state.Created && processAlive(c.Pid):
+		return oci.Created
+	case c.Status == state.Running && processAlive(c.Pid):
+		return oci.Running
+	}
+	return oci.Stopped
+}
+
+func ociStateOf(c *state.Container, status string) oci.State {
+	st := oci.State{
+		Version:     oci.Version,
+		ID:          c.ID,
+		Status:      status,
+		Bundle:      c.Bundle,
+		Annotations: c.Annotations,
+		Rootfs:      c.Rootfs,
+		Created:     c.Created,
+	}
+	if status == oci.Created || status == oci.Running {
+		st.Pid = c.Pid
+	}
+	return st
+}
+
+func loadOCI(id string) *state.Container {
+	c, err := store.Load(id)
+	if errors.Is(err, state.ErrNotFound) {
+		fatalf("container %s does not exist", id)
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+	return c
+}
+
+func ociStart(args []string, _ bool) int {
+	flags := flag.NewFlagSet("start", flag.ExitOnError)
+	flags.Parse(args)
+	id := ociID(flags, "start <id>")
+	c := loadOCI(id)
+	if status := ociStatus(c); status != oci.Created {
+		fatalf("container %s is %s, not created", id, status)
+	}
+
+	// the init writes a byte once it has the FIFO open, opening it for
+	// reading without blocking lets us notice it dying meanwhile
+	fifo := filepath.Join(store.Dir(id), execFifo)
+	fd, err := unix.Open(fifo, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		fatalf("container %s was already started: %v", id, err)
+	}
+	defer unix.Close(fd)
+	buf := make([]byte, 1)
+	for {
+		n, err := unix.Read(fd, buf)
+		if n == 1 {
+			break
+		}
+		if err != nil && err != unix.EAGAIN && err != unix.EINTR {
+			fatalf("start: %v", err)
+		}
+		if !processAlive(c.Pid) {
+			fatalf("container %s exited before it was started", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	os.Remove(fifo)
+	markRunning(id)
+
+	spec, err := loadSpec(id)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if spec.Hooks != nil {
+		// the container already runs, a failed hook only warns
+		if err := oci.RunHooks("poststart", spec.Hooks.Poststart, ociStateOf(c, oci.Running)); err != nil {
+			log.Printf("warn: %v", err)
+		}
+	}
+	return 0
+}
+
+func ociState(args []string, _ bool) int {
+	flags := flag.NewFlagSet("state", flag.ExitOnError)
+	flags.Parse(args)
+	c := loadOCI(ociID(flags, "state <id>"))
+	out, err := json.MarshalIndent(ociStateOf(c, ociStatus(c)), "", "  ")
+	if err != nil {
+		fatalf("%v", err)
+	}
+	fmt.Println(string(out))
+	return 0
+}
+
+func ociKill(args []string, _ bool) int {
+	flags := flag.NewFlagSet("kill", flag.ExitOnError)
+	all := flags.Bool("all", false, "signal every process in the container's cgroup")
+	flags.BoolVar(all, "a", false, "short for -all")
+	flags.Parse(args)
+	id := ociID(flags, "kill [-all] <id> [signal]")
+	sig := syscall.SIGTERM
+	if flags.NArg() > 1 {
+		s, err := parseSignal(flags.Arg(1))
+		if err != nil {
+			fatalf("%v", err)
+		}
+		sig = s
+	}
+	c := loadOCI(id)
+	if status := ociStatus(c); status != oci.Created && status != oci.Running {
+		fatalf("container %s is not running", id)
+	}
+	if err := signalOCI(c, sig, *all); err != nil {
+		fatalf("%v", err)
+	}
+	return 0
+}
+
+// signalOCI sends sig to the init of c, or with all to every process in
+// its cgroup
+func signalOCI(c *state.Container, sig syscall.Signal, all bool) error {
+	if !all || c.CgroupPath == "" {
+		if err := syscall.Kill(c.Pid, sig); err != nil {
+			return fmt.Errorf("signal %s: %w", unix.SignalName(sig), err)
+		}
+		return nil
+	}
+	if sig == syscall.SIGKILL {
+		return cgroup.Kill(c.CgroupPath)
+	}
+	pids, err := cgroup.Procs(c.CgroupPath)
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, sig); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("signal %s to %d: %w", unix.SignalName(sig), pid, err)
+		}
+	}
+	return nil
+}
+
+// shimExitTimeout is how long delete waits for the shim of a killed container
+const shimExitTimeout = 10 * time.Second
+
+func ociDelete(args []string, _ bool) int {
+	flags := flag.NewFlagSet("delete", flag.ExitOnError)
+	force := flags.Bool("force", false, "kill a running container before deleting it")
+	flags.BoolVar(force, "f", false, "short for -force")
+	flags.Parse(args)
+	id := ociID(flags, "delete [-force] <id>")
+	c, err := store.Load(id)
+	if errors.Is(err, state.ErrNotFound) && *force {
+		return 0
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	switch ociStatus(c) {
+	case oci.Running:
+		if !*force {
+			fatalf("container %s is running, stop it first or use -force", id)
+		}
+		fallthrough
+	case oci.Created:
+		if err := signalOCI(c, syscall.SIGKILL, true); err != nil {
+			log.Printf("warn: %v", err)
+		}
+	case oci.Creating:
+		syscall.Kill(c.ShimPid, syscall.SIGKILL)
+	}
+	deadline := time.Now().Add(shimExitTimeout)
+	for processAlive(c.ShimPid) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if c.CgroupPath != "" {
+		if err := cgroup.Remove(c.CgroupPath); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	if spec, err := loadSpec(id); err == nil && spec.Hooks != nil {
+		// the container is gone either way, a failed hook only warns
+		if err := oci.RunHooks("poststop", spec.Hooks.Poststop, ociStateOf(c, oci.Stopped)); err != nil {
+			log.Printf("warn: %v", err)
+		}
+	}
+	if err := store.Remove(id); err != nil {
+		fatalf("%v", err)
+	}
+	return 0
+}
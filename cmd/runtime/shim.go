@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"myruntime/pkg/logs"
+)
+
+// A detached container runs under a shim: the runtime re-executed as
+// "shim <id> <flags>", in its own session so it outlives the CLI. The shim
+// owns the container's stdio and records its exit status in the state store.
+
+// Files of a detached container in its state dir: the json-file log and
+// the socket attach connects to
+const (
+	logFile      = "json.log"
+	attachSocket = "attach.sock"
+)
+
+// shimReady is the pipe a shim reports to the CLI on, "ok" once the
+// container runs or an error message. Nil outside a shim.
+var shimReady *os.File
+
+func newID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// startShim starts the recorded container id detached and returns once it runs
+func startShim(id string, argv []string) int {
+	if err := spawnShim(id, argv); err != nil {
+		fatalf("%v", err)
+	}
+	fmt.Println(id)
+	return 0
+}
+
+// spawnShim starts "shim <id> argv" in a session of its own and waits until
+// it reports the container running or failed. stdio, when given, is passed
+// on as fds 4, 5 and 6.
+func spawnShim(id string, argv []string, stdio ...*os.File) error {
+	logFile, err := os.Create(filepath.Join(store.Dir(id), "shim.log"))
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(self, append([]string{"shim", id}, argv...)...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = append([]*os.File{w}, stdio...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("starting shim: %w", err)
+	}
+	cmd.Process.Release()
+
+	msg, _ := io.ReadAll(r)
+	switch status := strings.TrimSpace(string(msg)); status {
+	case "ok":
+		return nil
+	case "":
+		return fmt.Errorf("container %s failed to start, see %s", id[:min(12, len(id))], logFile.Name())
+	default:
+		return errors.New(status)
+	}
+}
+
+func shimMain(args []string) int {
+	if len(args) == 0 {
+		fatalf("usage: shim <id> [flags]")
+	}
+	shimReady = os.NewFile(3, "shim-ready")
+	syscall.CloseOnExec(3)
+	if len(args) > 1 && args[1] == "oci" {
+		return ociShim(args[0], args[2:])
+	}
+	return run(args[1:], args[0])
+}
+
+// shimStarted lets the CLI return once the container runs
+func shimStarted() {
+	if shimReady == nil {
+		return
+	}
+	shimReady.WriteString("ok")
+	shimReady.Close()
+	shimReady = nil
+}
+
+// shimFailed passes a fatal error to the waiting CLI
+func shimFailed(msg string) {
+	if shimReady != nil {
+		shimReady.WriteString(msg)
+	}
+}
+
+// logStream returns a pipe for the container to write stream to, copied into
+// the log and to out until every copy of it is closed
+func logStream(w *logs.Writer, out io.Writer, stream string, wg *sync.WaitGroup) *os.File {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer r.Close()
+		if err := w.Copy(stream, io.TeeReader(r, out)); err != nil {
+			log.Printf("warn: logging %s: %v", stream, err)
+		}
+	}()
+	return pw
+}
@@ -0,0 +1,338 @@
+package attach
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A shim serves the stdio of its container on a unix socket. Both ways data
+// travels in frames like Docker's multiplexed streams: an 8 byte header with
+// the stream in the first byte and the payload size big-endian in the last
+// four, then the payload.
+
+// Stream identifies what a frame carries
+type Stream byte
+
+const (
+	Stdin  Stream = 0
+	Stdout Stream = 1
+	Stderr Stream = 2
+	// Resize carries the client's terminal size, rows and columns as two
+	// big-endian uint16
+	Resize Stream = 3
+)
+
+// writeTimeout drops a client that stops reading, and bounds how long Close
+// waits for clients to get the last of the output
+const writeTimeout = 5 * time.Second
+
+// queueLen is how many frames a client may fall behind before it is dropped,
+// output is never held up by a slow client
+const queueLen = 256
+
+// MaxFrame is the largest payload ReadFrame accepts
+const MaxFrame = 1 << 20
+
+// WriteFrame sends p as one frame of stream s
+func WriteFrame(w io.Writer, s Stream, p []byte) error {
+	_, err := w.Write(frame(s, p))
+	return err
+}
+
+func frame(s Stream, p []byte) []byte {
+	buf := make([]byte, 8+len(p))
+	buf[0] = byte(s)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(p)))
+	copy(buf[8:], p)
+	return buf
+}
+
+// ReadFrame reads the next frame, refusing payloads over MaxFrame
+func ReadFrame(r io.Reader) (Stream, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[4:8])
+	if size > MaxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes is over the limit of %d", size, MaxFrame)
+	}
+	p := make([]byte, size)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return 0, nil, err
+	}
+	return Stream(hdr[0]), p, nil
+}
+
+// Server passes container output to every attached client and their input
+// to the container
+type Server struct {
+	ln      *net.UnixListener
+	stdin   io.Writer
+	resize  func(rows, cols uint16)
+	mu      sync.Mutex
+	clients map[*net.UnixConn]chan []byte
+	closed  bool
+	// writers are the goroutines sending each client its queue
+	writers sync.WaitGroup
+}
+
+// Listen serves on a socket at path. Input goes to stdin, dropped when it is
+// nil, and terminal sizes to resize, when set.
+func Listen(path string, stdin io.Writer, resize func(rows, cols uint16)) (*Server, error) {
+	os.Remove(path)
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("attach socket: %w", err)
+	}
+	s := &Server{ln: ln, stdin: stdin, resize: resize, clients: map[*net.UnixConn]chan []byte{}}
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) serve() {
+	for {
+		c, err := s.ln.AcceptUnix()
+		if err != nil {
+			return
+		}
+		queue := make(chan []byte, queueLen)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		s.clients[c] = queue
+		s.writers.Add(1)
+		s.mu.Unlock()
+		go s.send(c, queue)
+		go s.handle(c)
+	}
+}
+
+// send writes the frames queued for c until the queue is closed, then
+// disconnects it
+func (s *Server) send(c *net.UnixConn, queue chan []byte) {
+	defer s.writers.Done()
+	defer c.Close()
+	for frame := range queue {
+		c.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := c.Write(frame); err != nil {
+			s.drop(c)
+			return
+		}
+	}
+}
+
+func (s *Server) handle(c *net.UnixConn) {
+	defer s.drop(c)
+	for {
+		stream, p, err := ReadFrame(c)
+		if err != nil {
+			return
+		}
+		switch {
+		case stream == Stdin && s.stdin != nil:
+			if _, err := s.stdin.Write(p); err != nil {
+				log.Printf("warn: attach stdin: %v", err)
+			}
+		case stream == Resize && s.resize != nil && len(p) == 4:
+			s.resize(binary.BigEndian.Uint16(p[0:2]), binary.BigEndian.Uint16(p[2:4]))
+		}
+	}
+}
+
+// drop closes the queue of c, its writer disconnects it once the queue is sent
+func (s *Server) drop(c *net.UnixConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropLocked(c)
+}
+
+func (s *Server) dropLocked(c *net.UnixConn) {
+	if queue, ok := s.clients[c]; ok {
+		close(queue)
+		delete(s.clients, c)
+	}
+}
+
+// Output returns a writer that sends to every client as stream st. Writes
+// don't fail or block, clients that can't keep up are dropped.
+func (s *Server) Output(st Stream) io.Writer {
+	return output{s, st}
+}
+
+type output struct {
+	s  *Server
+	st Stream
+}
+
+func (o output) Write(p []byte) (int, error) {
+	// queued as is, p is the caller's to reuse
+	f := frame(o.st, p)
+	o.s.mu.Lock()
+	defer o.s.mu.Unlock()
+	for c, queue := range o.s.clients {
+		select {
+		case queue <- f:
+		default:
+			o.s.dropLocked(c)
+		}
+	}
+	return len(p), nil
+}
+
+// Close stops serving and disconnects every client once it got what is
+// queued for it, waiting no longer than writeTimeout
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.clients {
+		s.dropLocked(c)
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.writers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(writeTimeout):
+	}
+	return err
+}
+
+// ParseDetachKeys parses a comma-separated key sequence like Docker's
+// ctrl-p,ctrl-q: single characters or ctrl- plus a letter or one of @[\]^_
+func ParseDetachKeys(spec string) ([]byte, error) {
+	var keys []byte
+	for _, k := range strings.Split(spec, ",") {
+		switch {
+		case len(k) == 1:
+			keys = append(keys, k[0])
+		case len(k) == 6 && strings.HasPrefix(strings.ToLower(k), "ctrl-"):
+			c := k[5]
+			switch {
+			case c >= 'a' && c <= 'z':
+				keys = append(keys, c-'a'+1)
+			case c >= '@' && c <= '_':
+				keys = append(keys, c-'@')
+			default:
+				return nil, fmt.Errorf("invalid detach key %s", k)
+			}
+		default:
+			return nil, fmt.Errorf("invalid detach key %s", k)
+		}
+	}
+	return keys, nil
+}
+
+// ErrDetached is returned by Client.Input when the detach keys were typed
+var ErrDetached = errors.New("detached")
+
+// Client is a connection to a shim's attach socket
+type Client struct {
+	conn *net.UnixConn
+	mu   sync.Mutex
+}
+
+// Dial connects to the attach socket at path
+func Dial(path string) (*Client, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("attach: %w", err)
+	}
+	return &Client{conn: conn}, nil
+}
+
+func (c *Client) send(s Stream, p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return WriteFrame(c.conn, s, p)
+}
+
+// Resize tells the container's terminal the client's size
+func (c *Client) Resize(rows, cols uint16) error {
+	p := make([]byte, 4)
+	binary.BigEndian.PutUint16(p[0:2], rows)
+	binary.BigEndian.PutUint16(p[2:4], cols)
+	return c.send(Resize, p)
+}
+
+// Input sends r to the container's stdin until r ends, or returns
+// ErrDetached once keys were read. Keys that turn out not to complete the
+// sequence are passed on.
+func (c *Client) Input(r io.Reader, keys []byte) error {
+	buf := make([]byte, 4096)
+	matched := 0
+	for {
+		n, err := r.Read(buf)
+		var out []byte
+		detached := false
+		for _, b := range buf[:n] {
+			if matched > 0 && b != keys[matched] {
+				out = append(out, keys[:matched]...)
+				matched = 0
+			}
+			if len(keys) > 0 && b == keys[matched] {
+				matched++
+				if detached = matched == len(keys); detached {
+					break
+				}
+				continue
+			}
+			out = append(out, b)
+		}
+		if len(out) > 0 {
+			if err := c.send(Stdin, out); err != nil {
+				return err
+			}
+		}
+		if detached {
+			return ErrDetached
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Output copies the container's output to stdout and stderr until the
+// shim closes the connection
+func (c *Client) Output(stdout, stderr io.Writer) error {
+	for {
+		s, p, err := ReadFrame(c.conn)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		out := stdout
+		if s == Stderr {
+			out = stderr
+		}
+		if _, err := out.Write(p); err != nil {
+			return err
+		}
+	}
+}
+
+// Close disconnects, the container keeps running
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
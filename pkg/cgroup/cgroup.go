@@ -2,31 +2,220 @@ package cgroup
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
+// Root is where the cgroup v2 hierarchy is mounted
+const Root = "/sys/fs/cgroup"
+
 // CreateCG creates a cgroup v2 under /sys/fs/cgroup/myruntime-<name>-<ts>
 func CreateCG(name, cpu, memory string) (string, error) {
-	base := "/sys/fs/cgroup"
-	if _, err := os.Stat(base); err != nil {
-		return "", fmt.Errorf("cgroup v2 not available: %v", err)
+	path := filepath.Join(Root, fmt.Sprintf("myruntime-%s-%d", name, time.Now().Unix()))
+	limits := map[string]string{}
+	if cpu != "" {
+		limits["cpu.max"] = cpu
+	}
+	if memory != "" {
+		limits["memory.max"] = memory
 	}
-	cgName := fmt.Sprintf("myruntime-%s-%d", name, time.Now().Unix())
-	path := filepath.Join(base, cgName)
-	if err := os.MkdirAll(path, 0755); err != nil {
+	if err := Create(path, limits); err != nil {
 		return "", err
 	}
-	if cpu != "" {
-		if err := os.WriteFile(filepath.Join(path, "cpu.max"), []byte(cpu), 0644); err != nil {
-			return "", err
+	return path, nil
+}
+
+// Create creates the cgroup at path and writes limits, interface file
+// names and their values. The controllers the limits need are enabled on
+// the way down from Root.
+func Create(path string, limits map[string]string) error {
+	if _, err := os.Stat(Root); err != nil {
+		return fmt.Errorf("cgroup v2 not available: %v", err)
+	}
+	rel, err := filepath.Rel(Root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("cgroup %s is outside of %s", path, Root)
+	}
+	var enable []string
+	for file := range limits {
+		controller, _, _ := strings.Cut(file, ".")
+		if !slices.Contains(enable, "+"+controller) {
+			enable = append(enable, "+"+controller)
 		}
 	}
-	if memory != "" {
-		if err := os.WriteFile(filepath.Join(path, "memory.max"), []byte(memory), 0644); err != nil {
-			return "", err
+	dir := Root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if len(enable) > 0 {
+			// best effort, the limit itself reports a missing controller
+			os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0644)
+		}
+		dir = filepath.Join(dir, part)
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+			return err
 		}
 	}
-	return path, nil
+	for file, val := range limits {
+		if err := os.WriteFile(filepath.Join(path, file), []byte(val), 0644); err != nil {
+			return fmt.Errorf("cgroup %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// OOMKilled reports whether the OOM killer killed a process in the cgroup
+func OOMKilled(path string) bool {
+	n, err := event(path, "memory.events", "oom_kill")
+	return err == nil && n != "0"
+}
+
+// freezeTimeout is how long Freeze waits for every process to stop
+const freezeTimeout = 10 * time.Second
+
+// Freeze stops every process in the cgroup through the cgroup v2 freezer and
+// waits until the kernel reports them frozen
+func Freeze(path string) error {
+	if err := setFrozen(path, "1"); err != nil {
+		// don't leave it half frozen
+		setFrozen(path, "0")
+		return err
+	}
+	return nil
+}
+
+// Thaw lets the processes of a frozen cgroup run again
+func Thaw(path string) error {
+	return setFrozen(path, "0")
+}
+
+func setFrozen(path, val string) error {
+	if err := os.WriteFile(filepath.Join(path, "cgroup.freeze"), []byte(val), 0644); err != nil {
+		return fmt.Errorf("cgroup freeze: %w", err)
+	}
+	deadline := time.Now().Add(freezeTimeout)
+	for {
+		frozen, err := event(path, "cgroup.events", "frozen")
+		if err != nil {
+			return fmt.Errorf("cgroup freeze: %w", err)
+		}
+		if frozen == val {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cgroup %s: frozen still %s after %v", path, frozen, freezeTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// event returns the value of key in a flat keyed file like memory.events
+func event(path, file, key string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(path, file))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 && f[0] == key {
+			return f[1], nil
+		}
+	}
+	return "", fmt.Errorf("no %s in %s", key, file)
+}
+
+// Kill sends SIGKILL to every process in the cgroup and its descendants,
+// through cgroup.kill on Linux 5.14 and later. Older kernels lack it, there
+// the cgroup is frozen so nothing forks meanwhile and each process killed.
+func Kill(path string) error {
+	kill := filepath.Join(path, "cgroup.kill")
+	if _, err := os.Stat(kill); err == nil {
+		if err := os.WriteFile(kill, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("cgroup kill: %w", err)
+		}
+		return nil
+	}
+	if err := Freeze(path); err != nil {
+		return err
+	}
+	// fatal signals reach frozen processes, they die once thawed at the latest
+	defer Thaw(path)
+	pids, err := Procs(path)
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("kill %d: %w", pid, err)
+		}
+	}
+	return nil
+}
+
+// Procs lists the processes in the cgroup and its descendants
+func Procs(path string) ([]int, error) {
+	var pids []int
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(filepath.Join(p, "cgroup.procs"))
+		if err != nil {
+			return err
+		}
+		for _, f := range strings.Fields(string(data)) {
+			if pid, err := strconv.Atoi(f); err == nil {
+				pids = append(pids, pid)
+			}
+		}
+		return nil
+	})
+	return pids, err
+}
+
+// removeTimeout is how long Remove waits for killed processes to go
+const removeTimeout = 5 * time.Second
+
+// Remove deletes the cgroup and its descendants once cgroup.procs shows no
+// process in them. Ones left behind, that escaped the container's PID
+// namespace say, are killed first.
+func Remove(path string) error {
+	pids, err := Procs(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("remove cgroup: %w", err)
+	}
+	if len(pids) > 0 {
+		if err := Kill(path); err != nil {
+			return fmt.Errorf("remove cgroup: %w", err)
+		}
+		deadline := time.Now().Add(removeTimeout)
+		for len(pids) > 0 && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+			pids, _ = Procs(path)
+		}
+		if len(pids) > 0 {
+			return fmt.Errorf("remove cgroup %s: processes %v are still in it", path, pids)
+		}
+	}
+	// children before their parents
+	var dirs []string
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Remove(dirs[i]); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove cgroup: %w", err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,88 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// btrfsDriver keeps the image in a subvolume and gives each container a
+// writable snapshot of it. Size limits use qgroups instead of project quotas.
+type btrfsDriver struct {
+	opts StorageOptions
+}
+
+func (d *btrfsDriver) Name() string { return DriverBtrfs }
+
+func (d *btrfsDriver) paths(id string) (base, snap string) {
+	dir := filepath.Join(d.opts.Root, id)
+	return filepath.Join(dir, "base"), filepath.Join(dir, "snap")
+}
+
+func (d *btrfsDriver) Prepare(id, lower string) (string, error) {
+	base, snap := d.paths(id)
+	if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		return "", err
+	}
+	if err := btrfs("subvolume", "create", base); err != nil {
+		return "", err
+	}
+	// reflinks make the copy into the subvolume nearly free
+	if out, err := exec.Command("cp", "-a", "--reflink=auto", lower+"/.", base).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("copy image into subvolume failed: %v %s", err, out)
+	}
+	if err := btrfs("subvolume", "snapshot", base, snap); err != nil {
+		return "", err
+	}
+	if d.opts.Size > 0 {
+		if err := btrfs("quota", "enable", filepath.Dir(snap)); err != nil {
+			return "", err
+		}
+		if err := btrfs("qgroup", "limit", strconv.FormatInt(d.opts.Size, 10), snap); err != nil {
+			return "", err
+		}
+		return StorageQgroup, nil
+	}
+	return "", nil
+}
+
+func (d *btrfsDriver) Mount(id, target string) error {
+	_, snap := d.paths(id)
+	return bindMount(snap, target)
+}
+
+func (d *btrfsDriver) Unmount(id, target string) error {
+	return unmount(target)
+}
+
+func (d *btrfsDriver) Diff(id string) ([]Change, error) {
+	return treeChanges(d.paths(id))
+}
+
+func (d *btrfsDriver) Remove(id string) error {
+	base, snap := d.paths(id)
+	for _, sv := range []string{snap, base} {
+		if _, err := os.Stat(sv); err != nil {
+			continue
+		}
+		if err := btrfs("subvolume", "delete", sv); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(d.opts.Root, id))
+}
+
+// Usage counts extents shared with the image too, exclusive usage is only known to qgroups
+func (d *btrfsDriver) Usage(id string) (int64, error) {
+	_, snap := d.paths(id)
+	return diskUsage(snap)
+}
+
+func btrfs(args ...string) error {
+	if out, err := exec.Command("btrfs", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("btrfs %v failed: %v %s", args, err, out)
+	}
+	return nil
+}
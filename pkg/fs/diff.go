@@ -0,0 +1,192 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ChangeKind says how a path differs from the image
+type ChangeKind int
+
+const (
+	ChangeModify ChangeKind = iota
+	ChangeAdd
+	ChangeDelete
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdd:
+		return "A"
+	case ChangeDelete:
+		return "D"
+	}
+	return "C"
+}
+
+// Change is one path, relative to the rootfs, that differs from the image
+type Change struct {
+	Path string
+	Kind ChangeKind
+}
+
+// opaqueXattrs mark an upper dir that hides its lower one entirely: the
+// kernel's, the kernel's with userxattr and fuse-overlayfs'
+var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque", "user.fuseoverlayfs.opaque"}
+
+// opaqueWhiteout is the file fuse-overlayfs may mark an opaque dir with instead
+const opaqueWhiteout = ".wh..wh..opq"
+
+// overlayChanges reads changes straight from an overlay upper dir: whiteouts
+// (0/0 char devices) are deletions, anything else is an add or a modify. An
+// opaque dir was removed and recreated, what the lower one had and the upper
+// one doesn't is deleted too.
+func overlayChanges(lower, upper string) ([]Change, error) {
+	var changes []Change
+	// the opaque dir being walked, everything under it hides the lower too
+	var opaqueDir string
+	err := filepath.Walk(upper, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(upper, path)
+		if rel == "." || info.Name() == opaqueWhiteout {
+			return nil
+		}
+		rel = "/" + rel
+		if st := info.Sys().(*syscall.Stat_t); info.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0 {
+			changes = append(changes, Change{Path: rel, Kind: ChangeDelete})
+			return nil
+		}
+		kind := ChangeAdd
+		if _, err := os.Lstat(filepath.Join(lower, rel)); err == nil {
+			kind = ChangeModify
+		}
+		changes = append(changes, Change{Path: rel, Kind: kind})
+		inOpaque := opaqueDir != "" && strings.HasPrefix(rel, opaqueDir+"/")
+		if kind == ChangeModify && info.IsDir() && !inOpaque && opaque(path) {
+			opaqueDir = rel
+			hidden, err := hiddenChanges(filepath.Join(lower, rel), path, rel)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, hidden...)
+		}
+		return nil
+	})
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, err
+}
+
+func opaque(dir string) bool {
+	buf := make([]byte, 1)
+	for _, attr := range opaqueXattrs {
+		if n, err := unix.Lgetxattr(dir, attr, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	_, err := os.Lstat(filepath.Join(dir, opaqueWhiteout))
+	return err == nil
+}
+
+// hiddenChanges lists the entries of the lower dir an opaque upper dir hides
+// as deleted, unless the upper dir has one of the same name. Below an opaque
+// dir the lower is never merged, so dirs of the same name are compared too.
+// rel is the dir's path in the rootfs.
+func hiddenChanges(lowerDir, upperDir, rel string) ([]Change, error) {
+	var changes []Change
+	err := filepath.Walk(lowerDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		sub, _ := filepath.Rel(lowerDir, path)
+		if sub == "." {
+			return nil
+		}
+		if fi, err := os.Lstat(filepath.Join(upperDir, sub)); err == nil {
+			if info.IsDir() && !fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		changes = append(changes, Change{Path: filepath.Join(rel, sub), Kind: ChangeDelete})
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// treeChanges compares two full trees, as vfs and btrfs layers are complete copies
+func treeChanges(lower, layer string) ([]Change, error) {
+	var changes []Change
+	err := filepath.Walk(layer, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(layer, path)
+		if rel == "." {
+			return nil
+		}
+		rel = "/" + rel
+		orig, err := os.Lstat(filepath.Join(lower, rel))
+		if err != nil {
+			changes = append(changes, Change{Path: rel, Kind: ChangeAdd})
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !sameFile(filepath.Join(lower, rel), orig, path, info) {
+			changes = append(changes, Change{Path: rel, Kind: ChangeModify})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(lower, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(lower, path)
+		if rel == "." {
+			return nil
+		}
+		rel = "/" + rel
+		if _, err := os.Lstat(filepath.Join(layer, rel)); err != nil {
+			changes = append(changes, Change{Path: rel, Kind: ChangeDelete})
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, err
+}
+
+func sameFile(aPath string, a os.FileInfo, bPath string, b os.FileInfo) bool {
+	as, bs := a.Sys().(*syscall.Stat_t), b.Sys().(*syscall.Stat_t)
+	if a.Mode() != b.Mode() || as.Uid != bs.Uid || as.Gid != bs.Gid {
+		return false
+	}
+	switch {
+	case a.IsDir():
+		// a directory only changes through its entries, which are walked on their own
+		return true
+	case a.Mode()&os.ModeSymlink != 0:
+		al, _ := os.Readlink(aPath)
+		bl, _ := os.Readlink(bPath)
+		return al == bl
+	case a.Mode()&(os.ModeDevice|os.ModeCharDevice) != 0:
+		return unix.Major(as.Rdev) == unix.Major(bs.Rdev) && unix.Minor(as.Rdev) == unix.Minor(bs.Rdev)
+	}
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
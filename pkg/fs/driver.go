@@ -0,0 +1,143 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// StorageDriver manages the root filesystem of a container. Layers live under
+// the driver root, one directory per container id.
+type StorageDriver interface {
+	// Name is the driver name as accepted by NewStorageDriver
+	Name() string
+	// Prepare creates the writable layer of id on top of the extracted image in
+	// lower. It returns the backend limiting the layer's size, empty without one.
+	Prepare(id, lower string) (string, error)
+	// Mount makes the rootfs of id available at target
+	Mount(id, target string) error
+	Unmount(id, target string) error
+	// Diff lists what the container changed compared to its image
+	Diff(id string) ([]Change, error)
+	// Remove deletes everything Prepare created
+	Remove(id string) error
+	// Usage reports the bytes used by the writable layer
+	Usage(id string) (int64, error)
+}
+
+// StorageOptions configure a StorageDriver
+type StorageOptions struct {
+	// Root holds the per-container layer directories
+	Root string
+	// Size limits the writable layer, 0 means unlimited
+	Size int64
+	// RootUID and RootGID own the top of the writable layer, the host ids of
+	// container root when it runs in a user namespace
+	RootUID int
+	RootGID int
+}
+
+// Storage driver names. DriverOverlay, DriverFuseOverlay and DriverVFS are
+// shared with the rootless driver detection.
+const (
+	DriverBtrfs = "btrfs"
+	DriverAuto  = ""
+)
+
+// NewStorageDriver returns the named driver, or picks one when name is empty:
+// btrfs when root sits on btrfs, overlay when it can be mounted there, vfs otherwise.
+func NewStorageDriver(name string, opts StorageOptions) (StorageDriver, error) {
+	if err := os.MkdirAll(opts.Root, 0755); err != nil {
+		return nil, err
+	}
+	if name == DriverAuto {
+		name = detectDriver(opts.Root)
+	}
+	switch name {
+	case DriverOverlay, DriverFuseOverlay:
+		return &overlayDriver{opts: opts}, nil
+	case DriverVFS:
+		return &vfsDriver{opts: opts}, nil
+	case DriverBtrfs:
+		return &btrfsDriver{opts: opts}, nil
+	}
+	return nil, fmt.Errorf("unknown storage driver %q", name)
+}
+
+func detectDriver(root string) string {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(root, &st); err == nil && st.Type == unix.BTRFS_SUPER_MAGIC {
+		return DriverBtrfs
+	}
+	if overlaySupported(root) {
+		return DriverOverlay
+	}
+	return DriverVFS
+}
+
+// layerDir is where the writable layer of id lives. With a size limit it is
+// the quota-managed directory, so upper and work end up on the same filesystem.
+func layerDir(opts StorageOptions, id string) string {
+	if opts.Size > 0 {
+		return filepath.Join(opts.Root, id, "layer")
+	}
+	return filepath.Join(opts.Root, id)
+}
+
+// prepareLayer creates the layer directory of id, size-limited when
+// requested, and returns the quota backend in use
+func prepareLayer(opts StorageOptions, id string) (string, error) {
+	dir := layerDir(opts, id)
+	if opts.Size == 0 {
+		return "", os.MkdirAll(dir, 0755)
+	}
+	return SetupStorage(dir, opts.Size)
+}
+
+func removeLayer(opts StorageOptions, id string) error {
+	if err := TeardownStorage(layerDir(opts, id)); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(opts.Root, id))
+}
+
+// diskUsage sums the allocated blocks under dir, counting hard links once
+func diskUsage(dir string) (int64, error) {
+	var total int64
+	seen := map[uint64]bool{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if st.Nlink > 1 && !info.IsDir() {
+			if seen[st.Ino] {
+				return nil
+			}
+			seen[st.Ino] = true
+		}
+		total += st.Blocks * 512
+		return nil
+	})
+	return total, err
+}
+
+func bindMount(src, target string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(src, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s: %w", src, err)
+	}
+	return nil
+}
+
+func unmount(target string) error {
+	if err := syscall.Unmount(target, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL && !os.IsNotExist(err) {
+		return fmt.Errorf("unmount %s: %w", target, err)
+	}
+	return nil
+}
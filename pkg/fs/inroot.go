@@ -0,0 +1,161 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The rootfs of an image is untrusted: a symlink like /etc -> /host/etc must
+// not lead a mount or a created file out of the container. Paths in it are
+// resolved one component at a time from an fd of the rootfs, following
+// symlinks as if the rootfs were / and stopping .. at it, and mounts go
+// through the resulting fd as /proc/self/fd/N.
+
+// maxSymlinks is how many symlinks a path may go through, like the kernel's
+const maxSymlinks = 40
+
+// OpenInRoot opens path inside rootfs with O_PATH
+func OpenInRoot(rootfs, path string) (*os.File, error) {
+	return resolveInRoot(rootfs, path, false)
+}
+
+// MkdirInRoot creates path and its missing parents inside rootfs and opens
+// it with O_PATH
+func MkdirInRoot(rootfs, path string) (*os.File, error) {
+	return resolveInRoot(rootfs, path, true)
+}
+
+func resolveInRoot(rootfs, path string, mkdir bool) (*os.File, error) {
+	fail := func(err error) (*os.File, error) {
+		return nil, &os.PathError{Op: "resolve", Path: filepath.Join(rootfs, path), Err: err}
+	}
+	root, err := unix.Open(rootfs, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fail(err)
+	}
+	// the directories walked through, the last one is where we are
+	dirs := []int{root}
+	defer func() {
+		for _, fd := range dirs {
+			unix.Close(fd)
+		}
+	}()
+	rest := strings.Split(path, "/")
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(dirs) > 1 {
+				unix.Close(dirs[len(dirs)-1])
+				dirs = dirs[:len(dirs)-1]
+			}
+			continue
+		}
+		dir := dirs[len(dirs)-1]
+		fd, err := unix.Openat(dir, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err == unix.ENOENT && mkdir {
+			if err = unix.Mkdirat(dir, name, 0755); err == nil || err == unix.EEXIST {
+				fd, err = unix.Openat(dir, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			}
+		}
+		if err != nil {
+			return fail(err)
+		}
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err != nil {
+			unix.Close(fd)
+			return fail(err)
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFLNK {
+			dirs = append(dirs, fd)
+			continue
+		}
+		target, err := readlinkFd(fd)
+		unix.Close(fd)
+		if err != nil {
+			return fail(err)
+		}
+		if links++; links > maxSymlinks {
+			return fail(unix.ELOOP)
+		}
+		if filepath.IsAbs(target) {
+			for _, fd := range dirs[1:] {
+				unix.Close(fd)
+			}
+			dirs = dirs[:1]
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	if len(dirs) == 1 {
+		// the rootfs itself
+		dirs = nil
+		return os.NewFile(uintptr(root), rootfs), nil
+	}
+	last := dirs[len(dirs)-1]
+	dirs = dirs[:len(dirs)-1]
+	return os.NewFile(uintptr(last), filepath.Join(rootfs, path)), nil
+}
+
+func readlinkFd(fd int) (string, error) {
+	buf := make([]byte, unix.PathMax)
+	n, err := unix.Readlinkat(fd, "", buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+// createInRoot opens path inside rootfs, creating an empty file there and
+// its parent directories if nothing is there yet
+func createInRoot(rootfs, path string) (*os.File, error) {
+	f, err := OpenInRoot(rootfs, path)
+	if !os.IsNotExist(err) {
+		return f, err
+	}
+	dir, err := MkdirInRoot(rootfs, filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Openat(int(dir.Fd()), filepath.Base(path), unix.O_CREAT|unix.O_EXCL|unix.O_WRONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0644)
+	dir.Close()
+	if err != nil {
+		return nil, &os.PathError{Op: "create", Path: filepath.Join(rootfs, path), Err: err}
+	}
+	unix.Close(fd)
+	return OpenInRoot(rootfs, path)
+}
+
+// WriteFileInRoot writes data to the existing file path inside rootfs
+func WriteFileInRoot(rootfs, path string, data []byte) error {
+	f, err := OpenInRoot(rootfs, path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// the O_PATH fd is opened again for writing through /proc
+	return os.WriteFile(procPath(f), data, 0)
+}
+
+// procPath is a path of what f refers to that mount(2) follows to it
+func procPath(f *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+}
+
+// atPath calls fn with a /proc/self/fd path of path inside rootfs, for a
+// mount on top of what was just mounted there
+func atPath(rootfs, path string, fn func(target string) error) error {
+	f, err := OpenInRoot(rootfs, path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fn(procPath(f))
+}
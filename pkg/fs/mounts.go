@@ -0,0 +1,434 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Tmpfs describes a tmpfs mount inside the container rootfs
+type Tmpfs struct {
+	Destination string
+	Flags       uintptr
+	Data        string
+}
+
+var tmpfsFlags = map[string]struct {
+	set   bool
+	value uintptr
+}{
+	"ro":       {true, syscall.MS_RDONLY},
+	"rw":       {false, syscall.MS_RDONLY},
+	"nosuid":   {true, syscall.MS_NOSUID},
+	"suid":     {false, syscall.MS_NOSUID},
+	"nodev":    {true, syscall.MS_NODEV},
+	"dev":      {false, syscall.MS_NODEV},
+	"noexec":   {true, syscall.MS_NOEXEC},
+	"exec":     {false, syscall.MS_NOEXEC},
+	"noatime":  {true, syscall.MS_NOATIME},
+	"atime":    {false, syscall.MS_NOATIME},
+	"relatime": {true, syscall.MS_RELATIME},
+}
+
+// ParseTmpfs parses a /path[:opt,opt=val,...] spec. Mount flags (ro, noexec, ...)
+// are split out, everything else (size, mode, uid, gid, nr_inodes) is passed to tmpfs.
+func ParseTmpfs(spec string) (Tmpfs, error) {
+	dest, opts, _ := strings.Cut(spec, ":")
+	dest = filepath.Clean(strings.TrimSpace(dest))
+	if !filepath.IsAbs(dest) {
+		return Tmpfs{}, fmt.Errorf("tmpfs destination %q must be absolute", dest)
+	}
+	if dest == "/" {
+		return Tmpfs{}, errors.New("tmpfs cannot be mounted over /")
+	}
+	t := Tmpfs{Destination: dest, Flags: syscall.MS_NOSUID | syscall.MS_NODEV}
+	var data []string
+	for _, o := range strings.Split(opts, ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		if f, ok := tmpfsFlags[o]; ok {
+			if f.set {
+				t.Flags |= f.value
+			} else {
+				t.Flags &^= f.value
+			}
+			continue
+		}
+		data = append(data, o)
+	}
+	t.Data = strings.Join(data, ",")
+	return t, nil
+}
+
+// MountTmpfs mounts t under rootfs, creating the mountpoint if needed
+func MountTmpfs(rootfs string, t Tmpfs) error {
+	target, err := MkdirInRoot(rootfs, t.Destination)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	if err := syscall.Mount("tmpfs", procPath(target), "tmpfs", t.Flags, t.Data); err != nil {
+		return fmt.Errorf("mount tmpfs %s: %w", t.Destination, err)
+	}
+	return nil
+}
+
+// BindFile bind-mounts the file src over dest in rootfs, replacing a symlink
+// or creating an empty file there first so there is something to mount on.
+func BindFile(rootfs, src, dest string) error {
+	dir, err := MkdirInRoot(rootfs, filepath.Dir(dest))
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(dest)
+	var st unix.Stat_t
+	if err := unix.Fstatat(int(dir.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		unix.Unlinkat(int(dir.Fd()), name, 0)
+	}
+	dir.Close()
+	target, err := createInRoot(rootfs, dest)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	if err := syscall.Mount(src, procPath(target), "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind %s: %w", dest, err)
+	}
+	return nil
+}
+
+// MakePrivate stops mounts made in the current mount namespace from
+// propagating back to the host.
+func MakePrivate() error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make / private: %w", err)
+	}
+	return nil
+}
+
+// statfs ST_* bits and the matching MS_* mount flags
+var statfsFlags = map[int64]uintptr{
+	unix.ST_NOSUID:   syscall.MS_NOSUID,
+	unix.ST_NODEV:    syscall.MS_NODEV,
+	unix.ST_NOEXEC:   syscall.MS_NOEXEC,
+	unix.ST_NOATIME:  syscall.MS_NOATIME,
+	unix.ST_RELATIME: syscall.MS_RELATIME,
+}
+
+// RemountReadOnly flips an existing mount to read-only. Submounts keep their own flags.
+func RemountReadOnly(target string) error {
+	// a vfs rootfs is a plain directory, bind it onto itself so there is a mount to flip
+	if err := syscall.Mount(target, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s: %w", target, err)
+	}
+	return remountReadOnly(target)
+}
+
+// remountReadOnly flips the bind mount at target to read-only
+func remountReadOnly(target string) error {
+	// carry over the flags the mount already has, the kernel refuses to
+	// clear locked ones inside a user namespace
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err == nil {
+		for bit, ms := range statfsFlags {
+			if st.Flags&bit != 0 {
+				flags |= ms
+			}
+		}
+	}
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("remount %s read-only: %w", target, err)
+	}
+	return nil
+}
+
+// Mount is a filesystem mounted into the container, an OCI spec mount
+type Mount struct {
+	Source      string   `json:"source,omitempty"`
+	Destination string   `json:"destination"`
+	Type        string   `json:"type,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// mountFlags are the options a Mount takes besides the tmpfs ones
+var mountFlags = map[string]uintptr{
+	"bind":        syscall.MS_BIND,
+	"rbind":       syscall.MS_BIND | syscall.MS_REC,
+	"strictatime": unix.MS_STRICTATIME,
+	"sync":        syscall.MS_SYNCHRONOUS,
+	"dirsync":     syscall.MS_DIRSYNC,
+}
+
+var propagationFlags = map[string]uintptr{
+	"private":     syscall.MS_PRIVATE,
+	"rprivate":    syscall.MS_PRIVATE | syscall.MS_REC,
+	"shared":      syscall.MS_SHARED,
+	"rshared":     syscall.MS_SHARED | syscall.MS_REC,
+	"slave":       syscall.MS_SLAVE,
+	"rslave":      syscall.MS_SLAVE | syscall.MS_REC,
+	"unbindable":  syscall.MS_UNBINDABLE,
+	"runbindable": syscall.MS_UNBINDABLE | syscall.MS_REC,
+}
+
+// MountInto mounts m under rootfs, creating the mountpoint if needed. Bind
+// mounts of files get a file to mount on, read-only binds are remounted since
+// the kernel ignores flags on the first bind.
+func MountInto(rootfs string, m Mount) error {
+	var flags, propagation uintptr
+	var data []string
+	for _, o := range m.Options {
+		if f, ok := tmpfsFlags[o]; ok {
+			if f.set {
+				flags |= f.value
+			} else {
+				flags &^= f.value
+			}
+		} else if f, ok := mountFlags[o]; ok {
+			flags |= f
+		} else if f, ok := propagationFlags[o]; ok {
+			propagation |= f
+		} else {
+			data = append(data, o)
+		}
+	}
+	typ := m.Type
+	// cgroup v2 hosts only have the unified hierarchy
+	if typ == "cgroup" {
+		typ = "cgroup2"
+	}
+
+	if flags&syscall.MS_BIND != 0 {
+		fi, err := os.Stat(m.Source)
+		if err != nil {
+			return fmt.Errorf("mount %s: %w", m.Destination, err)
+		}
+		var target *os.File
+		if fi.IsDir() {
+			target, err = MkdirInRoot(rootfs, m.Destination)
+		} else {
+			target, err = createInRoot(rootfs, m.Destination)
+		}
+		if err != nil {
+			return err
+		}
+		err = syscall.Mount(m.Source, procPath(target), "", flags&(syscall.MS_BIND|syscall.MS_REC), "")
+		target.Close()
+		if err != nil {
+			return fmt.Errorf("bind %s: %w", m.Destination, err)
+		}
+		if rest := flags &^ (syscall.MS_BIND | syscall.MS_REC); rest != 0 {
+			err := atPath(rootfs, m.Destination, func(target string) error {
+				return syscall.Mount("", target, "", rest|syscall.MS_BIND|syscall.MS_REMOUNT, "")
+			})
+			if err != nil {
+				return fmt.Errorf("remount %s: %w", m.Destination, err)
+			}
+		}
+	} else {
+		target, err := MkdirInRoot(rootfs, m.Destination)
+		if err != nil {
+			return err
+		}
+		err = syscall.Mount(m.Source, procPath(target), typ, flags, strings.Join(data, ","))
+		target.Close()
+		if err != nil {
+			return fmt.Errorf("mount %s %s: %w", typ, m.Destination, err)
+		}
+	}
+	if propagation != 0 {
+		err := atPath(rootfs, m.Destination, func(target string) error {
+			return syscall.Mount("", target, "", propagation, "")
+		})
+		if err != nil {
+			return fmt.Errorf("set propagation of %s: %w", m.Destination, err)
+		}
+	}
+	return nil
+}
+
+// defaultDevices are bound from the host into every /dev the runtime fills,
+// binding works where mknod isn't allowed
+var defaultDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// DevMounts are the mounts of a /dev like Docker's: a tmpfs first, then
+// devpts and shm on it
+var DevMounts = []Mount{
+	{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+	{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}},
+	{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+}
+
+// Device is a device node created in the container, like an OCI
+// linux.devices entry
+type Device struct {
+	Path string `json:"path"`
+	// Type is c or u for a character device, b for a block device, p for a FIFO
+	Type     string       `json:"type"`
+	Major    int64        `json:"major,omitempty"`
+	Minor    int64        `json:"minor,omitempty"`
+	FileMode *os.FileMode `json:"fileMode,omitempty"`
+	UID      *uint32      `json:"uid,omitempty"`
+	GID      *uint32      `json:"gid,omitempty"`
+}
+
+var deviceTypes = map[string]uint32{
+	"c": unix.S_IFCHR,
+	"u": unix.S_IFCHR,
+	"b": unix.S_IFBLK,
+	"p": unix.S_IFIFO,
+}
+
+// Validate rejects devices of an unknown type or at a relative path
+func (d Device) Validate() error {
+	if !filepath.IsAbs(d.Path) || filepath.Clean(d.Path) == "/" {
+		return fmt.Errorf("invalid device path %q", d.Path)
+	}
+	if _, ok := deviceTypes[d.Type]; !ok {
+		return fmt.Errorf("device %s has invalid type %q", d.Path, d.Type)
+	}
+	return nil
+}
+
+// MountDevices fills the container's /dev with the default devices, then
+// creates devices, which take the place of default ones at the same path,
+// and the usual links into /proc and /dev/pts
+func MountDevices(rootfs string, devices []Device) error {
+	given := map[string]bool{}
+	for _, d := range devices {
+		given[filepath.Clean(d.Path)] = true
+	}
+	for _, d := range defaultDevices {
+		path := filepath.Join("/dev", d)
+		if given[path] {
+			continue
+		}
+		if err := BindFile(rootfs, path, path); err != nil {
+			return err
+		}
+	}
+	for _, d := range devices {
+		if err := makeDevice(rootfs, d); err != nil {
+			return err
+		}
+	}
+	dev, err := MkdirInRoot(rootfs, "/dev")
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	links := [][2]string{
+		{"/proc/self/fd", "fd"},
+		{"/proc/self/fd/0", "stdin"},
+		{"/proc/self/fd/1", "stdout"},
+		{"/proc/self/fd/2", "stderr"},
+		{"pts/ptmx", "ptmx"},
+	}
+	for _, l := range links {
+		if err := unix.Symlinkat(l[0], int(dev.Fd()), l[1]); err != nil && err != unix.EEXIST {
+			return fmt.Errorf("link /dev/%s: %w", l[1], err)
+		}
+	}
+	return nil
+}
+
+// makeDevice creates d with mknod, or where that isn't allowed, in a user
+// namespace say, binds the host's node at the same path if it is the same
+// device
+func makeDevice(rootfs string, d Device) error {
+	mode := uint32(0666)
+	if d.FileMode != nil {
+		mode = uint32(d.FileMode.Perm())
+	}
+	dev := int(unix.Mkdev(uint32(d.Major), uint32(d.Minor)))
+	dir, err := MkdirInRoot(rootfs, filepath.Dir(d.Path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	fd, name := int(dir.Fd()), filepath.Base(d.Path)
+	// whatever the image has there gives way
+	if err := unix.Unlinkat(fd, name, 0); err != nil && err != unix.ENOENT {
+		return fmt.Errorf("create device %s: %w", d.Path, err)
+	}
+	err = unix.Mknodat(fd, name, deviceTypes[d.Type]|mode, dev)
+	if err == unix.EPERM {
+		var st unix.Stat_t
+		if serr := unix.Stat(d.Path, &st); serr != nil || st.Mode&unix.S_IFMT != deviceTypes[d.Type] || int(st.Rdev) != dev {
+			return fmt.Errorf("create device %s: %w, and the host has no such device to bind", d.Path, err)
+		}
+		return BindFile(rootfs, d.Path, d.Path)
+	}
+	if err != nil {
+		return fmt.Errorf("create device %s: %w", d.Path, err)
+	}
+	// mknod applies the umask
+	if err := unix.Fchmodat(fd, name, mode, 0); err != nil {
+		return fmt.Errorf("create device %s: %w", d.Path, err)
+	}
+	if d.UID != nil || d.GID != nil {
+		uid, gid := -1, -1
+		if d.UID != nil {
+			uid = int(*d.UID)
+		}
+		if d.GID != nil {
+			gid = int(*d.GID)
+		}
+		if err := unix.Fchownat(fd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return fmt.Errorf("create device %s: %w", d.Path, err)
+		}
+	}
+	return nil
+}
+
+// MaskPath hides path in the container behind /dev/null, or an empty
+// read-only tmpfs for directories. Missing paths are left alone.
+func MaskPath(rootfs, path string) error {
+	target, err := OpenInRoot(rootfs, path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	var st unix.Stat_t
+	if err := unix.Fstat(int(target.Fd()), &st); err != nil {
+		return fmt.Errorf("mask %s: %w", path, err)
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		err = syscall.Mount("tmpfs", procPath(target), "tmpfs", syscall.MS_RDONLY, "")
+	} else {
+		err = syscall.Mount("/dev/null", procPath(target), "", syscall.MS_BIND, "")
+	}
+	if err != nil {
+		return fmt.Errorf("mask %s: %w", path, err)
+	}
+	return nil
+}
+
+// ReadonlyPath makes path in the container read-only. Missing paths are
+// left alone.
+func ReadonlyPath(rootfs, path string) error {
+	target, err := OpenInRoot(rootfs, path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount(procPath(target), procPath(target), "", syscall.MS_BIND|syscall.MS_REC, "")
+	target.Close()
+	if err != nil {
+		return fmt.Errorf("bind %s: %w", path, err)
+	}
+	// the bind mount is only reached by opening the path again
+	return atPath(rootfs, path, remountReadOnly)
+}
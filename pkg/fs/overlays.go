@@ -3,10 +3,33 @@ package fs
 import (
 	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"syscall"
+
+	"myruntime/pkg/internal/kernel"
 )
 
 func MountOverlay(lower, upper, work, target string) error {
+	return mountOverlayOpts(lower, upper, work, target)
+}
+
+func mountOverlayOpts(lower, upper, work, target string, extra ...string) error {
+	if err := prepareOverlayDirs(upper, work, target); err != nil {
+		return err
+	}
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if len(extra) > 0 {
+		opts += "," + strings.Join(extra, ",")
+	}
+	if err := syscall.Mount("overlay", target, "overlay", 0, opts); err != nil {
+		return fmt.Errorf("mount overlay: %w", err)
+	}
+	return nil
+}
+
+func prepareOverlayDirs(upper, work, target string) error {
 	os.RemoveAll(target)
 	if err := os.MkdirAll(upper, 0755); err != nil {
 		return err
@@ -17,9 +40,121 @@ func MountOverlay(lower, upper, work, target string) error {
 	if err := os.MkdirAll(target, 0755); err != nil {
 		return err
 	}
-	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
-	if err := syscall.Mount("overlay", target, "overlay", 0, opts); err != nil {
-		return fmt.Errorf("mount overlay: %w", err)
+	return nil
+}
+
+// overlayDriver stacks upper over the image with a kernel overlay mount, or
+// fuse-overlayfs inside a user namespace on kernels that can't do it.
+type overlayDriver struct {
+	opts StorageOptions
+	// via is the overlay implementation the last Mount used
+	via string
+}
+
+func (d *overlayDriver) Name() string {
+	if d.via != "" {
+		return d.via
+	}
+	return DriverOverlay
+}
+
+func (d *overlayDriver) paths(id string) (lower, upper, work string) {
+	layer := layerDir(d.opts, id)
+	lower, _ = os.Readlink(filepath.Join(d.opts.Root, id, "image"))
+	return lower, filepath.Join(layer, "upper"), filepath.Join(layer, "work")
+}
+
+func (d *overlayDriver) Prepare(id, lower string) (string, error) {
+	backend, err := prepareLayer(d.opts, id)
+	if err != nil {
+		return "", err
 	}
+	// the merged root directory takes its owner from upper
+	_, upper, _ := d.paths(id)
+	if err := os.MkdirAll(upper, 0755); err != nil {
+		return "", err
+	}
+	if err := os.Lchown(upper, d.opts.RootUID, d.opts.RootGID); err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(lower)
+	if err != nil {
+		return "", err
+	}
+	link := filepath.Join(d.opts.Root, id, "image")
+	os.Remove(link)
+	return backend, os.Symlink(abs, link)
+}
+
+func (d *overlayDriver) Mount(id, target string) error {
+	lower, upper, work := d.paths(id)
+	via, err := mountOverlayAny(lower, upper, work, target)
+	if err != nil {
+		return err
+	}
+	d.via = via
 	return nil
 }
+
+func (d *overlayDriver) Unmount(id, target string) error {
+	return unmount(target)
+}
+
+func (d *overlayDriver) Diff(id string) ([]Change, error) {
+	lower, upper, _ := d.paths(id)
+	return overlayChanges(lower, upper)
+}
+
+func (d *overlayDriver) Remove(id string) error {
+	return removeLayer(d.opts, id)
+}
+
+func (d *overlayDriver) Usage(id string) (int64, error) {
+	_, upper, _ := d.paths(id)
+	return diskUsage(upper)
+}
+
+// mountOverlayAny mounts an overlay the way the current namespace allows and
+// reports which driver did it
+func mountOverlayAny(lower, upper, work, target string) (string, error) {
+	if !InUserNS() {
+		return DriverOverlay, MountOverlay(lower, upper, work, target)
+	}
+	var errs []string
+	if kernel.AtLeast("5.11") {
+		err := mountOverlayOpts(lower, upper, work, target, "userxattr")
+		if err == nil {
+			return DriverOverlay, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if path, err := exec.LookPath("fuse-overlayfs"); err == nil {
+		err := mountFuseOverlay(path, lower, upper, work, target)
+		if err == nil {
+			return DriverFuseOverlay, nil
+		}
+		errs = append(errs, err.Error())
+	} else {
+		errs = append(errs, "fuse-overlayfs not found")
+	}
+	return "", fmt.Errorf("overlay unavailable: %s", strings.Join(errs, "; "))
+}
+
+// overlaySupported probes whether an overlay with its upper dir on root can be mounted
+func overlaySupported(root string) bool {
+	probe, err := os.MkdirTemp(root, ".overlay-probe-")
+	if err != nil {
+		return false
+	}
+	defer os.RemoveAll(probe)
+	lower := filepath.Join(probe, "lower")
+	if err := os.MkdirAll(lower, 0755); err != nil {
+		return false
+	}
+	target := filepath.Join(probe, "merged")
+	if _, err := mountOverlayAny(lower, filepath.Join(probe, "upper"), filepath.Join(probe, "work"), target); err != nil {
+		return false
+	}
+	unmount(target)
+	return true
+}
@@ -0,0 +1,215 @@
+package fs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Backends that can limit the size of the writable layer
+const (
+	StorageProjectQuota = "project-quota"
+	StorageLoopback     = "loopback"
+	StorageQgroup       = "btrfs-qgroup"
+)
+
+// quotactl(2) and FS_IOC_FS[GS]ETXATTR bits not exported by x/sys/unix
+const (
+	qSetQuota        = 0x800008
+	prjQuota         = 2
+	qifBLimits       = 1
+	qifBlockSize     = 1024
+	fsIocFsGetXattr  = 0x801c581f
+	fsIocFsSetXattr  = 0x401c5820
+	fsXflagProjInher = 0x200
+)
+
+type dqblk struct {
+	BHardLimit uint64
+	BSoftLimit uint64
+	CurSpace   uint64
+	IHardLimit uint64
+	ISoftLimit uint64
+	CurInodes  uint64
+	BTime      uint64
+	ITime      uint64
+	Valid      uint32
+	_          uint32
+}
+
+type fsxattr struct {
+	XFlags     uint32
+	ExtSize    uint32
+	NExtents   uint32
+	ProjID     uint32
+	CowExtSize uint32
+	_          [8]byte
+}
+
+// ParseSize parses sizes like 512m, 10G or 1048576 into bytes
+func ParseSize(size string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(size))
+	s = strings.TrimSuffix(s, "b")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k':
+			mult = 1 << 10
+		case 'm':
+			mult = 1 << 20
+		case 'g':
+			mult = 1 << 30
+		case 't':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return v * mult, nil
+}
+
+// SetupStorage makes dir a size-limited home for the writable layer. Project
+// quotas are used when the filesystem under dir has them enabled (xfs or ext4
+// mounted with prjquota), otherwise a sparse ext4 image is loop-mounted on dir.
+// It returns the backend in use.
+func SetupStorage(dir string, size int64) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	qerr := setProjectQuota(dir, size)
+	if qerr == nil {
+		return StorageProjectQuota, nil
+	}
+	if err := setupLoopback(dir, size); err != nil {
+		return "", fmt.Errorf("project quota: %v; loopback: %w", qerr, err)
+	}
+	return StorageLoopback, nil
+}
+
+// TeardownStorage undoes SetupStorage. Project quotas go away with the
+// directory, a loopback image has to be unmounted first.
+func TeardownStorage(dir string) error {
+	if _, err := os.Stat(dir + ".img"); err != nil {
+		return nil
+	}
+	if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return fmt.Errorf("unmount %s: %w", dir, err)
+	}
+	return os.Remove(dir + ".img")
+}
+
+func setProjectQuota(dir string, size int64) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return err
+	}
+	if st.Type != unix.XFS_SUPER_MAGIC && st.Type != unix.EXT4_SUPER_MAGIC {
+		return fmt.Errorf("filesystem type %#x has no project quotas", st.Type)
+	}
+	dev, err := blockDevice(dir)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var fi syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &fi); err != nil {
+		return err
+	}
+	// inode numbers are unique per filesystem, which makes them usable project ids
+	projID := uint32(fi.Ino&0x7fffffff) | 1
+
+	var attr fsxattr
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFsGetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return fmt.Errorf("get fsxattr: %w", errno)
+	}
+	attr.ProjID = projID
+	attr.XFlags |= fsXflagProjInher
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFsSetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return fmt.Errorf("set project id: %w", errno)
+	}
+
+	devPtr, err := syscall.BytePtrFromString(dev)
+	if err != nil {
+		return err
+	}
+	limit := uint64(size+qifBlockSize-1) / qifBlockSize
+	q := dqblk{BHardLimit: limit, BSoftLimit: limit, Valid: qifBLimits}
+	cmd := qSetQuota<<8 | prjQuota
+	if _, _, errno := syscall.Syscall6(syscall.SYS_QUOTACTL, uintptr(cmd), uintptr(unsafe.Pointer(devPtr)), uintptr(projID), uintptr(unsafe.Pointer(&q)), 0, 0); errno != 0 {
+		return fmt.Errorf("quotactl %s: %w", dev, errno)
+	}
+	return nil
+}
+
+// blockDevice finds the device backing the filesystem that holds path
+func blockDevice(path string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", err
+	}
+	want := fmt.Sprintf("%d:%d", unix.Major(st.Dev), unix.Minor(st.Dev))
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		pre, post, ok := strings.Cut(sc.Text(), " - ")
+		fields := strings.Fields(pre)
+		if !ok || len(fields) < 3 || fields[2] != want {
+			continue
+		}
+		if src := strings.Fields(post); len(src) >= 2 && strings.HasPrefix(src[1], "/dev/") {
+			return src[1], nil
+		}
+	}
+	return "", fmt.Errorf("no block device found for %s", path)
+}
+
+func setupLoopback(dir string, size int64) error {
+	img := dir + ".img"
+	f, err := os.OpenFile(img, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// sparse: blocks are only allocated as the container writes
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		os.Remove(img)
+		return err
+	}
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-m", "0", img).CombinedOutput(); err != nil {
+		os.Remove(img)
+		return fmt.Errorf("mkfs.ext4 failed: %v %s", err, out)
+	}
+	if out, err := exec.Command("mount", "-o", "loop", img, dir).CombinedOutput(); err != nil {
+		os.Remove(img)
+		return fmt.Errorf("loop mount failed: %v %s", err, out)
+	}
+	// a fresh ext4 has lost+found, overlay doesn't mind but keep the layer clean
+	os.Remove(filepath.Join(dir, "lost+found"))
+	return nil
+}
@@ -0,0 +1,114 @@
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Rootfs drivers usable without real root
+const (
+	DriverOverlay     = "overlay"
+	DriverFuseOverlay = "fuse-overlayfs"
+	DriverVFS         = "vfs"
+)
+
+// InUserNS reports whether we run inside a user namespace other than the initial one
+func InUserNS() bool {
+	f, err := os.Open("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		return false
+	}
+	// the initial namespace maps the whole range: "0 0 4294967295"
+	fields := strings.Fields(sc.Text())
+	return !(len(fields) == 3 && fields[0] == "0" && fields[1] == "0" && fields[2] == "4294967295")
+}
+
+func mountFuseOverlay(bin, lower, upper, work, target string) error {
+	if err := prepareOverlayDirs(upper, work, target); err != nil {
+		return err
+	}
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if out, err := exec.Command(bin, "-o", opts, target).CombinedOutput(); err != nil {
+		return fmt.Errorf("fuse-overlayfs failed: %v %s", err, out)
+	}
+	return nil
+}
+
+// copyRootfs copies src into dst keeping modes, ownership (best effort) and links
+func copyRootfs(src, dst string) error {
+	os.RemoveAll(dst)
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		st := info.Sys().(*syscall.Stat_t)
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, mode.Perm()); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := copyFile(path, target, mode.Perm()); err != nil {
+				return err
+			}
+		default:
+			// devices, fifos, sockets
+			if err := unix.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+				fmt.Fprintf(os.Stderr, "warn: could not create %s: %v\n", target, err)
+				return nil
+			}
+		}
+
+		os.Lchown(target, int(st.Uid), int(st.Gid))
+		if info.Mode()&os.ModeSymlink == 0 {
+			// chown clears setuid bits, put them back
+			os.Chmod(target, info.Mode())
+			os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,66 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// vfsDriver gives every container a full copy of its image. Slow and
+// space hungry, but works on any filesystem and without privileges.
+type vfsDriver struct {
+	opts StorageOptions
+}
+
+func (d *vfsDriver) Name() string { return DriverVFS }
+
+func (d *vfsDriver) dir(id string) string {
+	return filepath.Join(layerDir(d.opts, id), "diff")
+}
+
+func (d *vfsDriver) Prepare(id, lower string) (string, error) {
+	backend, err := prepareLayer(d.opts, id)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(lower)
+	if err != nil {
+		return "", err
+	}
+	link := filepath.Join(d.opts.Root, id, "image")
+	os.Remove(link)
+	if err := os.Symlink(abs, link); err != nil {
+		return "", err
+	}
+	return backend, copyRootfs(lower, d.dir(id))
+}
+
+func (d *vfsDriver) Mount(id, target string) error {
+	if err := bindMount(d.dir(id), target); err == nil {
+		return nil
+	} else if !InUserNS() {
+		return err
+	}
+	// without a mount namespace of our own the copy itself becomes the rootfs
+	os.RemoveAll(target)
+	return os.Symlink(d.dir(id), target)
+}
+
+func (d *vfsDriver) Unmount(id, target string) error {
+	if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return os.Remove(target)
+	}
+	return unmount(target)
+}
+
+func (d *vfsDriver) Diff(id string) ([]Change, error) {
+	lower, _ := os.Readlink(filepath.Join(d.opts.Root, id, "image"))
+	return treeChanges(lower, d.dir(id))
+}
+
+func (d *vfsDriver) Remove(id string) error {
+	return removeLayer(d.opts, id)
+}
+
+func (d *vfsDriver) Usage(id string) (int64, error) {
+	return diskUsage(d.dir(id))
+}
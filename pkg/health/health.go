@@ -0,0 +1,151 @@
+package health
+
+import (
+	"time"
+)
+
+// Health statuses
+const (
+	Starting  = "starting"
+	Healthy   = "healthy"
+	Unhealthy = "unhealthy"
+)
+
+// defaults like Docker's
+const (
+	DefaultInterval = 30 * time.Second
+	DefaultTimeout  = 30 * time.Second
+	DefaultRetries  = 3
+)
+
+// MaxLog is how many probe results a container keeps, MaxOutput how much of
+// the output of each
+const (
+	MaxLog    = 5
+	MaxOutput = 4096
+)
+
+// Config is a healthcheck in the form of an image's HEALTHCHECK. Test is
+// ["CMD", args...] to run args, ["CMD-SHELL", command] to run command with
+// /bin/sh -c, or ["NONE"] for no healthcheck. Zero fields are unset.
+type Config struct {
+	Test        []string      `json:"test"`
+	Interval    time.Duration `json:"interval,omitempty"`
+	Timeout     time.Duration `json:"timeout,omitempty"`
+	StartPeriod time.Duration `json:"startPeriod,omitempty"`
+	Retries     int           `json:"retries,omitempty"`
+}
+
+// Command is the command a probe runs, nil when there is none
+func (c *Config) Command() []string {
+	if c == nil || len(c.Test) < 2 {
+		return nil
+	}
+	switch c.Test[0] {
+	case "CMD":
+		return c.Test[1:]
+	case "CMD-SHELL":
+		return []string{"/bin/sh", "-c", c.Test[1]}
+	}
+	return nil
+}
+
+// Merge returns the healthcheck of a container: the fields set in override
+// replace the image's, unset ones get Docker's defaults. It is nil when
+// neither has a command.
+func Merge(image *Config, override Config) *Config {
+	c := Config{}
+	if image != nil {
+		c = *image
+	}
+	if len(override.Test) > 0 {
+		c.Test = override.Test
+	}
+	if override.Interval > 0 {
+		c.Interval = override.Interval
+	}
+	if override.Timeout > 0 {
+		c.Timeout = override.Timeout
+	}
+	if override.StartPeriod > 0 {
+		c.StartPeriod = override.StartPeriod
+	}
+	if override.Retries > 0 {
+		c.Retries = override.Retries
+	}
+	if c.Command() == nil {
+		return nil
+	}
+	if c.Interval <= 0 {
+		c.Interval = DefaultInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.Retries <= 0 {
+		c.Retries = DefaultRetries
+	}
+	return &c
+}
+
+// Result is the outcome of one probe, an exit code of -1 means it timed out
+type Result struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	ExitCode int       `json:"exitCode"`
+	Output   string    `json:"output"`
+}
+
+// State is the health of a container and its latest probe results
+type State struct {
+	Status        string   `json:"status"`
+	FailingStreak int      `json:"failingStreak"`
+	Log           []Result `json:"log"`
+}
+
+// Record adds the result of a probe of a container started at started. A
+// success makes it healthy, Retries failures in a row unhealthy; failures of
+// a starting container within the start period don't count.
+func (s *State) Record(r Result, c *Config, started time.Time) {
+	if len(r.Output) > MaxOutput {
+		r.Output = r.Output[:MaxOutput]
+	}
+	s.Log = append(s.Log, r)
+	if len(s.Log) > MaxLog {
+		s.Log = s.Log[len(s.Log)-MaxLog:]
+	}
+	if r.ExitCode == 0 {
+		s.Status = Healthy
+		s.FailingStreak = 0
+		return
+	}
+	if s.Status == Starting && r.Start.Sub(started) < c.StartPeriod {
+		return
+	}
+	s.FailingStreak++
+	if s.FailingStreak >= c.Retries {
+		s.Status = Unhealthy
+	}
+}
+
+// Monitor runs probe every interval until stop is closed and passes the
+// results to record. It returns once the last probe finished.
+func Monitor(c *Config, probe func(args []string, timeout time.Duration) Result, record func(Result), stop <-chan struct{}) {
+	t := time.NewTicker(c.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		r := probe(c.Command(), c.Timeout)
+		select {
+		case <-stop:
+			// the container exited under the probe
+			return
+		default:
+		}
+		record(r)
+	}
+}
@@ -8,42 +8,74 @@ import (
 	"path/filepath"
 	"syscall"
 
+	"myruntime/pkg/health"
+
 	"golang.org/x/sys/unix"
 
 	"github.com/google/go-containerregistry/pkg/crane"
 )
 
-func ExportRootFS(ref, dest string) error {
+// Info is what the runtime uses of an image besides its filesystem
+type Info struct {
+	Digest string
+	// Healthcheck is the image's HEALTHCHECK, nil without one
+	Healthcheck *health.Config
+	// StopSignal is the image's STOPSIGNAL, empty without one
+	StopSignal string
+}
+
+// ExportRootFS pulls ref and extracts its filesystem into dest
+func ExportRootFS(ref, dest string) (Info, error) {
+	var info Info
 	// remove any existing
 	os.RemoveAll(dest)
 	if err := os.MkdirAll(dest, 0755); err != nil {
-		return err
+		return info, err
 	}
 	tmpFile, err := os.CreateTemp("", "export-*.tar")
 	if err != nil {
-		return fmt.Errorf("creating temp file: %w", err)
+		return info, fmt.Errorf("creating temp file: %w", err)
 	}
 	defer os.Remove(tmpFile.Name())
 
 	// First pull the image to get a v1.Image
 	img, err := crane.Pull(ref)
 	if err != nil {
-		return fmt.Errorf("pulling image: %w", err)
+		return info, fmt.Errorf("pulling image: %w", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return info, fmt.Errorf("image digest: %w", err)
+	}
+	info.Digest = digest.String()
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return info, fmt.Errorf("image config: %w", err)
+	}
+	info.StopSignal = cf.Config.StopSignal
+	if hc := cf.Config.Healthcheck; hc != nil {
+		info.Healthcheck = &health.Config{
+			Test:        hc.Test,
+			Interval:    hc.Interval,
+			Timeout:     hc.Timeout,
+			StartPeriod: hc.StartPeriod,
+			Retries:     hc.Retries,
+		}
 	}
 
 	// Then export the image
 	if err := crane.Export(img, tmpFile); err != nil {
-		return fmt.Errorf("crane export: %w", err)
+		return info, fmt.Errorf("crane export: %w", err)
 	}
 
 	if err := tmpFile.Sync(); err != nil {
-		return fmt.Errorf("syncing file: %w", err)
+		return info, fmt.Errorf("syncing file: %w", err)
 	}
 
 	// Extract the tar file to the destination directory
 	// Open the tar file for reading
 	if _, err := tmpFile.Seek(0, 0); err != nil {
-		return fmt.Errorf("seeking to start of file: %w", err)
+		return info, fmt.Errorf("seeking to start of file: %w", err)
 	}
 
 	tarReader := tar.NewReader(tmpFile)
@@ -54,7 +86,7 @@ func ExportRootFS(ref, dest string) error {
 			break // end of archive
 		}
 		if err != nil {
-			return fmt.Errorf("reading tar archive: %w", err)
+			return info, fmt.Errorf("reading tar archive: %w", err)
 		}
 
 		target := filepath.Join(dest, header.Name)
@@ -63,32 +95,32 @@ func ExportRootFS(ref, dest string) error {
 		case tar.TypeDir:
 			// create directory
 			if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
-				return fmt.Errorf("creating directory %s: %w", target, err)
+				return info, fmt.Errorf("creating directory %s: %w", target, err)
 			}
 
 		case tar.TypeReg:
 			// create regular file
 			w, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
 			if err != nil {
-				return fmt.Errorf("creating file %s: %w", target, err)
+				return info, fmt.Errorf("creating file %s: %w", target, err)
 			}
 			if _, err := io.Copy(w, tarReader); err != nil {
 				w.Close()
-				return fmt.Errorf("writing file contents %s: %w", target, err)
+				return info, fmt.Errorf("writing file contents %s: %w", target, err)
 			}
 			w.Close()
 
 		case tar.TypeSymlink:
 
 			if err := os.Symlink(header.Linkname, target); err != nil {
-				return fmt.Errorf("creating symlink %s -> %s: %w", target, header.Linkname, err)
+				return info, fmt.Errorf("creating symlink %s -> %s: %w", target, header.Linkname, err)
 			}
 
 		case tar.TypeLink:
 			// create hard link
 			linkTarget := filepath.Join(dest, header.Linkname)
 			if err := os.Link(linkTarget, target); err != nil {
-				return fmt.Errorf("creating hardlink %s -> %s: %w", target, linkTarget, err)
+				return info, fmt.Errorf("creating hardlink %s -> %s: %w", target, linkTarget, err)
 			}
 
 		case tar.TypeChar, tar.TypeBlock:
@@ -125,6 +157,5 @@ func ExportRootFS(ref, dest string) error {
 		}
 	}
 
-	return nil
-
+	return info, nil
 }
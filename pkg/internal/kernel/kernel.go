@@ -0,0 +1,33 @@
+package kernel
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// AtLeast reports whether the running kernel is at least version, given as
+// "major.minor". It is false when the release can't be read.
+func AtLeast(version string) bool {
+	var u unix.Utsname
+	if err := unix.Uname(&u); err != nil {
+		return false
+	}
+	have := parse(unix.ByteSliceToString(u.Release[:]))
+	want := parse(version)
+	return have[0] > want[0] || (have[0] == want[0] && have[1] >= want[1])
+}
+
+// parse takes major and minor from a release like "5.15.0-91-generic"
+func parse(v string) [2]int {
+	var out [2]int
+	for i, part := range strings.SplitN(v, ".", 3) {
+		if i > 1 {
+			break
+		}
+		part = strings.TrimRightFunc(part, func(r rune) bool { return r < '0' || r > '9' })
+		out[i], _ = strconv.Atoi(part)
+	}
+	return out
+}
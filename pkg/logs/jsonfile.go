@@ -0,0 +1,288 @@
+package logs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"myruntime/pkg/fs"
+)
+
+// Entry is one line of container output in Docker's json-file format
+type Entry struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// Options control log rotation
+type Options struct {
+	// MaxSize rotates the log once it would grow past it, 0 never rotates
+	MaxSize int64
+	// MaxFile is how many files are kept, the current one included
+	MaxFile int
+}
+
+// ParseOptions parses -log-opt values: max-size=<size> and max-file=<n>
+func ParseOptions(opts []string) (Options, error) {
+	o := Options{MaxFile: 1}
+	for _, opt := range opts {
+		key, val, _ := strings.Cut(opt, "=")
+		switch key {
+		case "max-size":
+			size, err := fs.ParseSize(val)
+			if err != nil || size <= 0 {
+				return o, fmt.Errorf("invalid log-opt %s", opt)
+			}
+			o.MaxSize = size
+		case "max-file":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return o, fmt.Errorf("invalid log-opt %s", opt)
+			}
+			o.MaxFile = n
+		default:
+			return o, fmt.Errorf("unknown log-opt %s", opt)
+		}
+	}
+	if o.MaxFile > 1 && o.MaxSize == 0 {
+		return o, fmt.Errorf("log-opt max-file needs max-size")
+	}
+	return o, nil
+}
+
+// Writer appends entries to a json-file log, rotating it to path.1, path.2
+// and so on. Rotation with a single file starts a new one in its place.
+type Writer struct {
+	path string
+	opts Options
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewWriter appends to the log at path
+func NewWriter(path string, opts Options) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Writer{path: path, opts: opts, f: f, size: st.Size()}, nil
+}
+
+// maxLine is how much of a line goes into one entry. Longer lines are split
+// into entries without the newline like Docker's 16 KiB partial messages,
+// output without newlines isn't held in memory.
+const maxLine = 16 * 1024
+
+// Copy writes every line read from r as an entry of stream until r ends
+func (w *Writer) Copy(stream string, r io.Reader) error {
+	br := bufio.NewReaderSize(r, maxLine)
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			if werr := w.write(Entry{Log: string(line), Stream: stream, Time: time.Now().UTC()}); werr != nil {
+				return werr
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (w *Writer) write(e Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.opts.MaxSize > 0 && w.size > 0 && w.size+int64(len(data)) > w.opts.MaxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.f.Write(data)
+	w.size += int64(n)
+	return err
+}
+
+func (w *Writer) rotate() error {
+	w.f.Close()
+	for i := w.opts.MaxFile - 1; i > 0; i-- {
+		from := w.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", w.path, i-1)
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", w.path, i)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotating log: %w", err)
+		}
+	}
+	// the new file replaces the old one rather than truncating it, a reader
+	// following the log finishes the old file and sees the new one start
+	tmp := w.path + "-new"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		f.Close()
+		return fmt.Errorf("rotating log: %w", err)
+	}
+	w.f, w.size = f, 0
+	return nil
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+// ReadOptions select the entries Read passes on
+type ReadOptions struct {
+	// Since skips older entries when set
+	Since time.Time
+	// Tail is how many of the last entries to start with, -1 for all
+	Tail int
+	// Follow keeps reading new entries until Stopped returns true
+	Follow  bool
+	Stopped func() bool
+}
+
+// Read passes the entries of the log at path and its rotated files to fn,
+// oldest first. With Follow it keeps waiting for new ones, across
+// rotations, until opts.Stopped says the container is gone.
+func Read(path string, opts ReadOptions, fn func(Entry) error) error {
+	// rotated files first, the highest number is the oldest
+	rotated, _ := filepath.Glob(path + ".*")
+	sort.Slice(rotated, func(i, j int) bool { return suffix(rotated[i]) > suffix(rotated[j]) })
+
+	var entries []Entry
+	keep := func(e Entry) error {
+		if e.Time.Before(opts.Since) {
+			return nil
+		}
+		if opts.Tail < 0 {
+			return fn(e)
+		}
+		entries = append(entries, e)
+		if len(entries) > opts.Tail {
+			entries = entries[1:]
+		}
+		return nil
+	}
+	for _, p := range rotated {
+		f, err := os.Open(p)
+		if err != nil {
+			// rotated away meanwhile
+			continue
+		}
+		err = readEntries(f, keep)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	if err := readEntries(f, keep); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	if !opts.Follow {
+		return nil
+	}
+
+	pass := func(e Entry) error {
+		if e.Time.Before(opts.Since) {
+			return nil
+		}
+		return fn(e)
+	}
+	for {
+		// checked before reading so nothing written before the end is missed
+		stopped := opts.Stopped()
+		if err := readEntries(f, pass); err != nil {
+			return err
+		}
+		if stopped {
+			return nil
+		}
+		cur, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		// rotation always puts a new file in place, finish the old one first
+		if st, err := os.Stat(path); err == nil && !os.SameFile(cur, st) {
+			if err := readEntries(f, pass); err != nil {
+				return err
+			}
+			nf, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			f.Close()
+			f = nf
+			continue
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// readEntries passes the complete lines of f from its offset on. A partly
+// written last line is left for the next call.
+func readEntries(f *os.File, fn func(Entry) error) error {
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			// back to the start of the unfinished line
+			f.Seek(int64(-len(line)), io.SeekCurrent)
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+func suffix(path string) int {
+	n, _ := strconv.Atoi(path[strings.LastIndex(path, ".")+1:])
+	return n
+}
@@ -0,0 +1,135 @@
+package netsetup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EtcFiles lists the files generated per container and bind-mounted over the image's copies
+var EtcFiles = []string{"hostname", "hosts", "resolv.conf"}
+
+// DNSConfig is what goes into the generated /etc files
+type DNSConfig struct {
+	Hostname   string
+	DNS        []string
+	DNSSearch  []string
+	ExtraHosts []string // host:ip
+}
+
+// ParseExtraHost validates a host:ip mapping
+func ParseExtraHost(s string) (string, string, error) {
+	host, ip, ok := strings.Cut(s, ":")
+	host = strings.TrimSpace(host)
+	ip = strings.TrimSpace(ip)
+	if !ok || host == "" {
+		return "", "", fmt.Errorf("invalid add-host %q, want host:ip", s)
+	}
+	if net.ParseIP(ip) == nil {
+		return "", "", fmt.Errorf("invalid add-host %q: bad ip %q", s, ip)
+	}
+	return host, ip, nil
+}
+
+// WriteEtcFiles generates hostname, hosts and resolv.conf in dir. ip is the
+// container address, empty while it isn't known yet.
+func WriteEtcFiles(dir string, c DNSConfig, ip string) error {
+	if err := os.WriteFile(filepath.Join(dir, "hostname"), []byte(c.Hostname+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := WriteHosts(dir, c, ip); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "resolv.conf"), resolvConf(c), 0644)
+}
+
+// WriteHosts rewrites dir/hosts in place so bind mounts of it see the update
+func WriteHosts(dir string, c DNSConfig, ip string) error {
+	var b bytes.Buffer
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	b.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	b.WriteString("fe00::0\tip6-localnet\n")
+	b.WriteString("ff00::0\tip6-mcastprefix\n")
+	b.WriteString("ff02::1\tip6-allnodes\n")
+	b.WriteString("ff02::2\tip6-allrouters\n")
+	if ip == "" {
+		ip = "127.0.1.1"
+	}
+	fmt.Fprintf(&b, "%s\t%s\n", ip, c.Hostname)
+	for _, h := range c.ExtraHosts {
+		host, hip, err := ParseExtraHost(h)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s\t%s\n", hip, host)
+	}
+	return os.WriteFile(filepath.Join(dir, "hosts"), b.Bytes(), 0644)
+}
+
+// resolvConf builds resolv.conf from the flags, falling back to the host's
+// settings. Loopback resolvers are unreachable from the container netns, so
+// those are replaced by systemd-resolved's upstream list or public servers.
+func resolvConf(c DNSConfig) []byte {
+	servers, search, options := hostResolvConf()
+	if len(c.DNS) > 0 {
+		servers = c.DNS
+	}
+	if len(c.DNSSearch) > 0 {
+		search = c.DNSSearch
+	}
+	if len(servers) == 0 {
+		servers = []string{"8.8.8.8", "8.8.4.4"}
+	}
+
+	var b bytes.Buffer
+	for _, s := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	if len(options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(options, " "))
+	}
+	return b.Bytes()
+}
+
+func hostResolvConf() (servers, search, options []string) {
+	for _, path := range []string{"/etc/resolv.conf", "/run/systemd/resolve/resolv.conf"} {
+		servers, search, options = readResolvConf(path)
+		if len(servers) > 0 {
+			return
+		}
+	}
+	return
+}
+
+func readResolvConf(path string) (servers, search, options []string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if ip := net.ParseIP(fields[1]); ip != nil && !ip.IsLoopback() {
+				servers = append(servers, fields[1])
+			}
+		case "search", "domain":
+			search = fields[1:]
+		case "options":
+			options = fields[1:]
+		}
+	}
+	return
+}
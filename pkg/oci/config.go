@@ -0,0 +1,167 @@
+package oci
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"myruntime/pkg/cgroup"
+	"myruntime/pkg/sandbox"
+	"myruntime/pkg/userns"
+)
+
+// Config maps the spec on to the sandbox configuration of container id in
+// bundle. Stdio, the gate and callbacks are left to the caller.
+func (s *Spec) Config(id, bundle string) (sandbox.Config, error) {
+	rootfs := s.Root.Path
+	if !filepath.IsAbs(rootfs) {
+		rootfs = filepath.Join(bundle, rootfs)
+	}
+	p := s.Process
+	cfg := sandbox.Config{
+		Name:          id,
+		Rootfs:        rootfs,
+		Args:          p.Args,
+		Env:           p.Env,
+		Cwd:           p.Cwd,
+		ReadOnly:      s.Root.Readonly,
+		Namespaces:    s.Linux.Namespaces,
+		Mounts:        s.Mounts,
+		Devices:       true,
+		ExtraDevices:  s.Linux.Devices,
+		Sysctl:        s.Linux.Sysctl,
+		MaskedPaths:   s.Linux.MaskedPaths,
+		ReadonlyPaths: s.Linux.ReadonlyPaths,
+		Seccomp:       s.Linux.Seccomp,
+		NoNewPrivs:    p.NoNewPrivileges,
+		OOMScoreAdj:   p.OOMScoreAdj,
+		TTY:           p.Terminal,
+		Interactive:   true,
+	}
+	cfg.Etc.Hostname = s.Hostname
+	if cfg.Env == nil {
+		cfg.Env = []string{}
+	}
+	if cfg.Namespaces == nil {
+		cfg.Namespaces = []sandbox.Namespace{}
+	}
+
+	// each set as given, none without capabilities
+	cfg.Capabilities = &sandbox.ProcessCaps{}
+	if p.Capabilities != nil {
+		cfg.Capabilities = p.Capabilities
+	}
+	if _, err := sandbox.ResolveProcessCaps(*cfg.Capabilities); err != nil {
+		return cfg, err
+	}
+
+	cfg.User = fmt.Sprintf("%d:%d", p.User.UID, p.User.GID)
+	for _, g := range p.User.AdditionalGids {
+		cfg.GroupAdd = append(cfg.GroupAdd, strconv.FormatUint(uint64(g), 10))
+	}
+	for _, r := range p.Rlimits {
+		name := strings.ToLower(strings.TrimPrefix(r.Type, "RLIMIT_"))
+		u, err := sandbox.ParseUlimit(fmt.Sprintf("%s=%d:%d", name, r.Soft, r.Hard))
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Ulimits = append(cfg.Ulimits, u)
+	}
+
+	if s.hasNamespace("user") {
+		if len(s.Linux.UIDMappings) == 0 || len(s.Linux.GIDMappings) == 0 {
+			return cfg, fmt.Errorf("a user namespace needs uid and gid mappings")
+		}
+		cfg.UIDMap = idMaps(s.Linux.UIDMappings)
+		cfg.GIDMap = idMaps(s.Linux.GIDMappings)
+	}
+	return cfg, nil
+}
+
+func idMaps(maps []IDMapping) []userns.IDMap {
+	out := make([]userns.IDMap, 0, len(maps))
+	for _, m := range maps {
+		out = append(out, userns.IDMap{ContainerID: int(m.ContainerID), HostID: int(m.HostID), Size: int(m.Size)})
+	}
+	return out
+}
+
+// CgroupPath is where the cgroup of container id goes: cgroupsPath under
+// the cgroup root, myruntime-<id> without one. systemd's slice:prefix:name
+// form is not supported.
+func (s *Spec) CgroupPath(id string, systemd bool) (string, error) {
+	p := s.Linux.CgroupsPath
+	if systemd {
+		return "", fmt.Errorf("systemd cgroups are not supported")
+	}
+	if p == "" {
+		p = "myruntime-" + id
+	}
+	path := filepath.Join(cgroup.Root, filepath.Clean("/"+p))
+	if path == cgroup.Root {
+		return "", fmt.Errorf("invalid cgroupsPath %q", s.Linux.CgroupsPath)
+	}
+	return path, nil
+}
+
+// CgroupLimits maps linux.resources on to cgroup v2 interface files.
+// linux.resources.unified is written as is and wins over the rest.
+func (s *Spec) CgroupLimits() map[string]string {
+	limits := map[string]string{}
+	r := s.Linux.Resources
+	if r == nil {
+		return limits
+	}
+	if m := r.Memory; m != nil {
+		setLimit(limits, "memory.max", m.Limit)
+		setLimit(limits, "memory.low", m.Reservation)
+		// v1's swap counts memory too, v2's doesn't
+		if m.Swap != nil && *m.Swap > 0 && m.Limit != nil && *m.Limit > 0 {
+			limits["memory.swap.max"] = strconv.FormatInt(max(*m.Swap-*m.Limit, 0), 10)
+		} else {
+			setLimit(limits, "memory.swap.max", m.Swap)
+		}
+	}
+	if c := r.CPU; c != nil {
+		if c.Quota != nil || c.Period != nil {
+			quota, period := "max", uint64(100000)
+			if c.Quota != nil && *c.Quota > 0 {
+				quota = strconv.FormatInt(*c.Quota, 10)
+			}
+			if c.Period != nil && *c.Period > 0 {
+				period = *c.Period
+			}
+			limits["cpu.max"] = fmt.Sprintf("%s %d", quota, period)
+		}
+		// shares 2..262144 on to weight 1..10000, the conversion runc uses
+		if c.Shares != nil && *c.Shares > 0 {
+			shares := min(max(*c.Shares, 2), 262144)
+			limits["cpu.weight"] = strconv.FormatUint(1+((shares-2)*9999)/262142, 10)
+		}
+		if c.Cpus != "" {
+			limits["cpuset.cpus"] = c.Cpus
+		}
+		if c.Mems != "" {
+			limits["cpuset.mems"] = c.Mems
+		}
+	}
+	if r.Pids != nil {
+		setLimit(limits, "pids.max", &r.Pids.Limit)
+	}
+	for file, val := range r.Unified {
+		limits[file] = val
+	}
+	return limits
+}
+
+// setLimit sets file to n, max when n is negative. Zero leaves it unset.
+func setLimit(limits map[string]string, file string, n *int64) {
+	switch {
+	case n == nil || *n == 0:
+	case *n < 0:
+		limits[file] = "max"
+	default:
+		limits[file] = strconv.FormatInt(*n, 10)
+	}
+}
@@ -0,0 +1,87 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// Version is the runtime-spec version the state is reported in
+const Version = "1.0.2"
+
+// Container statuses of the runtime-spec
+const (
+	Creating = "creating"
+	Created  = "created"
+	Running  = "running"
+	Stopped  = "stopped"
+)
+
+// State is the state of a container as the state command prints it and
+// hooks get it on stdin
+type State struct {
+	Version     string            `json:"ociVersion"`
+	ID          string            `json:"id"`
+	Status      string            `json:"status"`
+	Pid         int               `json:"pid,omitempty"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Rootfs, Created and Owner are what runc adds
+	Rootfs  string    `json:"rootfs,omitempty"`
+	Created time.Time `json:"created"`
+	Owner   string    `json:"owner"`
+}
+
+// RunHooks runs hooks one after the other with state on their stdin. The
+// first that fails or outlives its timeout ends the run.
+func RunHooks(kind string, hooks []Hook, state State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		if err := runHook(h, data); err != nil {
+			return fmt.Errorf("%s hook %s: %w", kind, h.Path, err)
+		}
+	}
+	return nil
+}
+
+func runHook(h Hook, state []byte) error {
+	ctx := context.Background()
+	if h.Timeout != nil {
+		if *h.Timeout <= 0 {
+			return errors.New("timeout must be positive")
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*h.Timeout)*time.Second)
+		defer cancel()
+	}
+	// args include argv[0] like execve's
+	cmd := exec.CommandContext(ctx, h.Path)
+	if len(h.Args) > 0 {
+		cmd.Args = h.Args
+	}
+	cmd.Env = h.Env
+	if cmd.Env == nil {
+		cmd.Env = []string{}
+	}
+	cmd.Stdin = bytes.NewReader(state)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out after %ds", *h.Timeout)
+	}
+	if err != nil {
+		if msg := bytes.TrimSpace(out.Bytes()); len(msg) > 0 {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
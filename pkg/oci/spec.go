@@ -0,0 +1,203 @@
+package oci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"myruntime/pkg/fs"
+	"myruntime/pkg/sandbox"
+	"myruntime/pkg/seccomp"
+)
+
+// SpecFile is the configuration of a bundle, next to its rootfs
+const SpecFile = "config.json"
+
+// Spec is the part of an OCI runtime-spec config.json the runtime
+// implements. Fields it can't honour are rejected by Validate rather than
+// silently ignored, unknown ones are.
+type Spec struct {
+	Version     string            `json:"ociVersion"`
+	Process     *Process          `json:"process"`
+	Root        *Root             `json:"root"`
+	Hostname    string            `json:"hostname,omitempty"`
+	Mounts      []fs.Mount        `json:"mounts,omitempty"`
+	Hooks       *Hooks            `json:"hooks,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Linux       *Linux            `json:"linux"`
+}
+
+// Process is the container process
+type Process struct {
+	Terminal        bool                 `json:"terminal,omitempty"`
+	User            User                 `json:"user"`
+	Args            []string             `json:"args"`
+	Env             []string             `json:"env,omitempty"`
+	Cwd             string               `json:"cwd"`
+	Capabilities    *sandbox.ProcessCaps `json:"capabilities,omitempty"`
+	Rlimits         []POSIXRlimit        `json:"rlimits,omitempty"`
+	NoNewPrivileges bool                 `json:"noNewPrivileges,omitempty"`
+	OOMScoreAdj     *int                 `json:"oomScoreAdj,omitempty"`
+}
+
+// User is who the process runs as, by id
+type User struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+// POSIXRlimit is a resource limit like RLIMIT_NOFILE
+type POSIXRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+// Root is the container's root filesystem, Path relative to the bundle
+type Root struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+// Hooks are commands run at points of the container's lifecycle
+type Hooks struct {
+	Prestart        []Hook `json:"prestart,omitempty"`
+	CreateRuntime   []Hook `json:"createRuntime,omitempty"`
+	CreateContainer []Hook `json:"createContainer,omitempty"`
+	StartContainer  []Hook `json:"startContainer,omitempty"`
+	Poststart       []Hook `json:"poststart,omitempty"`
+	Poststop        []Hook `json:"poststop,omitempty"`
+}
+
+// Hook is one command, Timeout in seconds
+type Hook struct {
+	Path    string   `json:"path"`
+	Args    []string `json:"args,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	Timeout *int     `json:"timeout,omitempty"`
+}
+
+// Linux is the Linux specific configuration
+type Linux struct {
+	UIDMappings   []IDMapping         `json:"uidMappings,omitempty"`
+	GIDMappings   []IDMapping         `json:"gidMappings,omitempty"`
+	Sysctl        map[string]string   `json:"sysctl,omitempty"`
+	Resources     *Resources          `json:"resources,omitempty"`
+	CgroupsPath   string              `json:"cgroupsPath,omitempty"`
+	Namespaces    []sandbox.Namespace `json:"namespaces,omitempty"`
+	Devices       []fs.Device         `json:"devices,omitempty"`
+	Seccomp       *seccomp.Profile    `json:"seccomp,omitempty"`
+	MaskedPaths   []string            `json:"maskedPaths,omitempty"`
+	ReadonlyPaths []string            `json:"readonlyPaths,omitempty"`
+}
+
+// IDMapping maps Size ids from ContainerID on to HostID
+type IDMapping struct {
+	ContainerID uint32 `json:"containerID"`
+	HostID      uint32 `json:"hostID"`
+	Size        uint32 `json:"size"`
+}
+
+// Resources are the cgroup limits of the container. Device rules are
+// accepted but not enforced: /dev only has the default devices, the ones in
+// linux.devices and mounts.
+type Resources struct {
+	Memory  *Memory           `json:"memory,omitempty"`
+	CPU     *CPU              `json:"cpu,omitempty"`
+	Pids    *Pids             `json:"pids,omitempty"`
+	Unified map[string]string `json:"unified,omitempty"`
+}
+
+// Memory limits in bytes, -1 for no limit. Swap is memory plus swap.
+type Memory struct {
+	Limit       *int64 `json:"limit,omitempty"`
+	Reservation *int64 `json:"reservation,omitempty"`
+	Swap        *int64 `json:"swap,omitempty"`
+}
+
+// CPU shares, a quota per period in microseconds and the cpuset
+type CPU struct {
+	Shares *uint64 `json:"shares,omitempty"`
+	Quota  *int64  `json:"quota,omitempty"`
+	Period *uint64 `json:"period,omitempty"`
+	Cpus   string  `json:"cpus,omitempty"`
+	Mems   string  `json:"mems,omitempty"`
+}
+
+// Pids caps the number of tasks, -1 for no limit
+type Pids struct {
+	Limit int64 `json:"limit"`
+}
+
+// LoadSpec reads the config.json of bundle
+func LoadSpec(bundle string) (*Spec, error) {
+	data, err := os.ReadFile(filepath.Join(bundle, SpecFile))
+	if err != nil {
+		return nil, err
+	}
+	var s Spec
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", SpecFile, err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Validate rejects what the runtime doesn't implement
+func (s *Spec) Validate() error {
+	switch {
+	case s.Process == nil:
+		return errors.New("spec has no process")
+	case len(s.Process.Args) == 0:
+		return errors.New("spec process has no args")
+	case s.Root == nil || s.Root.Path == "":
+		return errors.New("spec has no root path")
+	case s.Linux == nil:
+		return errors.New("spec has no linux section")
+	}
+	for _, d := range s.Linux.Devices {
+		if err := d.Validate(); err != nil {
+			return err
+		}
+	}
+	for key := range s.Linux.Sysctl {
+		ns, err := sandbox.SysctlNamespace(key)
+		if err != nil {
+			return err
+		}
+		if !s.hasNamespace(ns) {
+			return fmt.Errorf("sysctl %s needs a %s namespace", key, ns)
+		}
+	}
+	if h := s.Hooks; h != nil && (len(h.CreateContainer) > 0 || len(h.StartContainer) > 0) {
+		return errors.New("createContainer and startContainer hooks are not supported")
+	}
+	if s.Hostname != "" && !s.hasNamespace("uts") {
+		return errors.New("a hostname needs a uts namespace")
+	}
+	if s.Process.Cwd != "" && !filepath.IsAbs(s.Process.Cwd) {
+		return fmt.Errorf("process cwd %q is not absolute", s.Process.Cwd)
+	}
+	if s.Linux.Seccomp != nil {
+		// catch compile errors before anything is set up
+		if _, err := seccomp.Compile(s.Linux.Seccomp, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasNamespace reports whether the container gets or joins a namespace of typ
+func (s *Spec) hasNamespace(typ string) bool {
+	for _, ns := range s.Linux.Namespaces {
+		if ns.Type == typ {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package sandbox
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/syndtr/gocapability/capability"
+)
+
+// DefaultCaps is the capability set containers start from, the same 14 Docker uses
+var DefaultCaps = []capability.Cap{
+	capability.CAP_CHOWN,
+	capability.CAP_DAC_OVERRIDE,
+	capability.CAP_FSETID,
+	capability.CAP_FOWNER,
+	capability.CAP_MKNOD,
+	capability.CAP_NET_RAW,
+	capability.CAP_SETGID,
+	capability.CAP_SETUID,
+	capability.CAP_SETFCAP,
+	capability.CAP_SETPCAP,
+	capability.CAP_NET_BIND_SERVICE,
+	capability.CAP_SYS_CHROOT,
+	capability.CAP_KILL,
+	capability.CAP_AUDIT_WRITE,
+}
+
+// capNames holds every capability the running kernel knows, by CAP_ name
+var capNames = map[string]capability.Cap{}
+
+func init() {
+	for _, c := range capability.List() {
+		if c <= capability.CAP_LAST_CAP {
+			capNames["CAP_"+strings.ToUpper(c.String())] = c
+		}
+	}
+}
+
+// CapSet is the resolved capability configuration of a container process
+type CapSet struct {
+	// Caps is the bounding set, and the permitted, effective and inheritable
+	// ones unless the sets are explicit
+	Caps []capability.Cap
+	// Ambient survives exec for non-root users: the explicitly added caps
+	Ambient []capability.Cap
+	// explicit sets come from ResolveProcessCaps, ambient ones are then
+	// raised for root too
+	explicit                          bool
+	effective, permitted, inheritable []capability.Cap
+}
+
+// ProcessCaps names every capability set of a process, like an OCI
+// process.capabilities
+type ProcessCaps struct {
+	Bounding    []string `json:"bounding,omitempty"`
+	Effective   []string `json:"effective,omitempty"`
+	Inheritable []string `json:"inheritable,omitempty"`
+	Permitted   []string `json:"permitted,omitempty"`
+	Ambient     []string `json:"ambient,omitempty"`
+}
+
+// Names returns the CAP_ names of the resolved set
+func (s CapSet) Names() []string {
+	out := make([]string, 0, len(s.Caps))
+	for _, c := range s.Caps {
+		out = append(out, capName(c))
+	}
+	return out
+}
+
+// Has reports whether c is in the resolved effective set
+func (s CapSet) Has(c capability.Cap) bool {
+	if s.explicit {
+		return containsCap(s.effective, c)
+	}
+	return containsCap(s.Caps, c)
+}
+
+// ResolveCaps applies comma-separated cap-add and cap-drop lists to
+// DefaultCaps with Docker's rules: ALL in add keeps everything not dropped,
+// ALL in drop keeps only what is added, otherwise adds win over drops.
+// Names are case-insensitive, CAP_ is optional.
+func ResolveCaps(capAdd, capDrop string) (CapSet, error) {
+	adds, addAll, err := parseCaps(capAdd)
+	if err != nil {
+		return CapSet{}, err
+	}
+	drops, dropAll, err := parseCaps(capDrop)
+	if err != nil {
+		return CapSet{}, err
+	}
+	if addAll {
+		adds = nil
+		for _, c := range capNames {
+			adds = append(adds, c)
+		}
+	}
+
+	var caps []capability.Cap
+	switch {
+	case addAll:
+		for _, c := range adds {
+			if !containsCap(drops, c) {
+				caps = append(caps, c)
+			}
+		}
+	case dropAll:
+		caps = adds
+	default:
+		for _, c := range DefaultCaps {
+			if !containsCap(drops, c) && c <= capability.CAP_LAST_CAP {
+				caps = append(caps, c)
+			}
+		}
+		for _, c := range adds {
+			if !containsCap(caps, c) {
+				caps = append(caps, c)
+			}
+		}
+	}
+
+	set := CapSet{Caps: caps}
+	for _, c := range adds {
+		if set.Has(c) {
+			set.Ambient = append(set.Ambient, c)
+		}
+	}
+	return set, nil
+}
+
+// ResolveProcessCaps takes each set as given. Sets the kernel would refuse
+// are errors: effective caps that aren't permitted, inheritable ones outside
+// the bounding set and ambient ones that aren't both permitted and
+// inheritable.
+func ResolveProcessCaps(p ProcessCaps) (CapSet, error) {
+	set := CapSet{explicit: true}
+	for _, s := range []struct {
+		names []string
+		caps  *[]capability.Cap
+	}{
+		{p.Bounding, &set.Caps},
+		{p.Effective, &set.effective},
+		{p.Permitted, &set.permitted},
+		{p.Inheritable, &set.inheritable},
+		{p.Ambient, &set.Ambient},
+	} {
+		caps, all, err := parseCaps(strings.Join(s.names, ","))
+		if err != nil {
+			return CapSet{}, err
+		}
+		if all {
+			return CapSet{}, fmt.Errorf("capability sets list capabilities by name, not ALL")
+		}
+		*s.caps = caps
+	}
+	for _, c := range set.effective {
+		if !containsCap(set.permitted, c) {
+			return CapSet{}, fmt.Errorf("effective capability %s is not permitted", capName(c))
+		}
+	}
+	for _, c := range set.inheritable {
+		if !containsCap(set.Caps, c) {
+			return CapSet{}, fmt.Errorf("inheritable capability %s is not in the bounding set", capName(c))
+		}
+	}
+	for _, c := range set.Ambient {
+		if !containsCap(set.permitted, c) || !containsCap(set.inheritable, c) {
+			return CapSet{}, fmt.Errorf("ambient capability %s is not permitted and inheritable", capName(c))
+		}
+	}
+	return set, nil
+}
+
+func capName(c capability.Cap) string {
+	return "CAP_" + strings.ToUpper(c.String())
+}
+
+func parseCaps(s string) (caps []capability.Cap, all bool, err error) {
+	seen := map[capability.Cap]bool{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(strings.ToUpper(p))
+		if p == "" {
+			continue
+		}
+		if p == "ALL" {
+			all = true
+			continue
+		}
+		if !strings.HasPrefix(p, "CAP_") {
+			p = "CAP_" + p
+		}
+		c, ok := capNames[p]
+		if !ok {
+			return nil, false, fmt.Errorf("unknown capability %s", p)
+		}
+		if !seen[c] {
+			caps = append(caps, c)
+			seen[c] = true
+		}
+	}
+	return caps, all, nil
+}
+
+func containsCap(caps []capability.Cap, c capability.Cap) bool {
+	for _, have := range caps {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
+// applyBoundingCaps drops everything outside set from the bounding set. It
+// needs CAP_SETPCAP, so it runs before switching to the container user.
+func applyBoundingCaps(set CapSet) error {
+	capset, err := capability.NewPid2(0)
+	if err != nil {
+		return fmt.Errorf("failed to load capabilities: %w", err)
+	}
+	if err := capset.Load(); err != nil {
+		return fmt.Errorf("failed to load capabilities: %w", err)
+	}
+	capset.Clear(capability.BOUNDS)
+	capset.Set(capability.BOUNDING, set.Caps...)
+	if err := capset.Apply(capability.BOUNDS); err != nil {
+		return fmt.Errorf("failed to apply bounding set: %w", err)
+	}
+	return nil
+}
+
+// applyCaps restricts the calling process to set. Ambient caps are only
+// raised for non-root users, root gets its permitted set back on exec anyway,
+// unless the sets are explicit.
+func applyCaps(set CapSet) error {
+	capset, err := capability.NewPid2(0)
+	if err != nil {
+		return fmt.Errorf("failed to load capabilities: %w", err)
+	}
+	if err := capset.Load(); err != nil {
+		return fmt.Errorf("failed to load capabilities: %w", err)
+	}
+	capset.Clear(capability.CAPS | capability.AMBS)
+	kinds := capability.CAPS
+	if set.explicit {
+		capset.Set(capability.EFFECTIVE, set.effective...)
+		capset.Set(capability.PERMITTED, set.permitted...)
+		capset.Set(capability.INHERITABLE, set.inheritable...)
+	} else {
+		capset.Set(capability.CAPS, set.Caps...)
+	}
+	if set.explicit || syscall.Getuid() != 0 {
+		capset.Set(capability.AMBIENT, set.Ambient...)
+		kinds |= capability.AMBS
+	}
+	if err := capset.Apply(kinds); err != nil {
+		return fmt.Errorf("failed to apply capabilities: %w", err)
+	}
+	return nil
+}
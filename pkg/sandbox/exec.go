@@ -0,0 +1,81 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultPath is the PATH of the container process, also used to find the command
+const DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Exit codes for failures outside the container command, the same as Docker's
+const (
+	// ExitRuntimeError is for the runtime itself failing
+	ExitRuntimeError = 125
+	ExitCannotInvoke = 126
+	ExitNotFound     = 127
+)
+
+// lookPath resolves file against path like execvp: names with a slash are
+// used as is, others are searched in each PATH entry. A match that can't be
+// executed is remembered, so a later entry can still win.
+func lookPath(file, path string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, checkExecutable(file)
+	}
+	var denied error
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		p := filepath.Join(dir, file)
+		err := checkExecutable(p)
+		if err == nil {
+			return p, nil
+		}
+		if errors.Is(err, syscall.EACCES) && denied == nil {
+			denied = err
+		}
+	}
+	if denied != nil {
+		return "", denied
+	}
+	return "", fmt.Errorf("exec: %q: executable file not found in $PATH", file)
+}
+
+func checkExecutable(p string) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		var pe *os.PathError
+		if errors.As(err, &pe) {
+			err = pe.Err
+		}
+		return fmt.Errorf("exec: %q: %w", p, err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("exec: %q: %w", p, syscall.EACCES)
+	}
+	if err := unix.Access(p, unix.X_OK); err != nil {
+		return fmt.Errorf("exec: %q: %w", p, err)
+	}
+	return nil
+}
+
+// execExitCode maps a failed lookup or exec to Docker's exit status:
+// 127 when there is nothing to run, 126 when it can't be run
+func execExitCode(err error) int {
+	if errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.ENOEXEC) || errors.Is(err, syscall.EISDIR) {
+		return ExitCannotInvoke
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) && errno != syscall.ENOENT && errno != syscall.ENOTDIR {
+		return ExitCannotInvoke
+	}
+	return ExitNotFound
+}
@@ -0,0 +1,151 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"myruntime/pkg/fs"
+	"myruntime/pkg/seccomp"
+)
+
+// initArg0 is argv[0] of the re-executed runtime acting as container init
+const initArg0 = "myruntime-init"
+
+// fds the init process inherits from Run
+const (
+	configFd = 3
+	syncFd   = 4
+	errorFd  = 5
+	// readyFd only exists with Config.Gate: the init writes gateWaiting
+	// once it waits at the gate and gateOpened once start opened it
+	readyFd = 6
+)
+
+const (
+	gateWaiting = 1
+	gateOpened  = 2
+)
+
+// initConfig is everything the init process needs, sent by Run as JSON over
+// the config pipe. The init process environment is the container's.
+type initConfig struct {
+	Name    string   `json:"name"`
+	Rootfs  string   `json:"rootfs"`
+	Args    []string `json:"args"`
+	CapAdd  string   `json:"capAdd,omitempty"`
+	CapDrop string   `json:"capDrop,omitempty"`
+	// Capabilities replaces CapAdd and CapDrop when set
+	Capabilities *ProcessCaps     `json:"capabilities,omitempty"`
+	ReadOnly     bool             `json:"readOnly,omitempty"`
+	Tmpfs        []string         `json:"tmpfs,omitempty"`
+	Hostname     string           `json:"hostname,omitempty"`
+	EtcDir       string           `json:"etcDir,omitempty"`
+	Seccomp      *seccomp.Profile `json:"seccomp,omitempty"`
+	NoNewPrivs   bool             `json:"noNewPrivileges,omitempty"`
+	Ulimits      []Ulimit         `json:"ulimits,omitempty"`
+	OOMScoreAdj  *int             `json:"oomScoreAdj,omitempty"`
+	User         string           `json:"user,omitempty"`
+	GroupAdd     []string         `json:"groupAdd,omitempty"`
+	Init         bool             `json:"init,omitempty"`
+	TTY          bool             `json:"tty,omitempty"`
+	// Namespaces are the ones the init enters itself
+	Namespaces []Namespace `json:"namespaces,omitempty"`
+	// Mounts keeps an empty list apart from none, which mounts /proc
+	Mounts        []fs.Mount        `json:"mounts"`
+	Devices       bool              `json:"devices,omitempty"`
+	ExtraDevices  []fs.Device       `json:"extraDevices,omitempty"`
+	Sysctl        map[string]string `json:"sysctl,omitempty"`
+	MaskedPaths   []string          `json:"maskedPaths,omitempty"`
+	ReadonlyPaths []string          `json:"readonlyPaths,omitempty"`
+	Cwd           string            `json:"cwd,omitempty"`
+	Gate          string            `json:"gate,omitempty"`
+}
+
+func writeInitConfig(w io.WriteCloser, c initConfig) error {
+	defer w.Close()
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		return fmt.Errorf("sending config to init: %w", err)
+	}
+	return nil
+}
+
+// savedConfig is the file in Config.StateDir that keeps the init config for Exec
+const savedConfig = "config.json"
+
+func saveInitConfig(dir string, c initConfig) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, savedConfig), data, 0600); err != nil {
+		return fmt.Errorf("saving init config: %w", err)
+	}
+	return nil
+}
+
+func loadInitConfig(dir string) (initConfig, error) {
+	var c initConfig
+	data, err := os.ReadFile(filepath.Join(dir, savedConfig))
+	if err != nil {
+		return c, fmt.Errorf("loading container config: %w", err)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("loading container config: %w", err)
+	}
+	return c, nil
+}
+
+func readInitConfig() (initConfig, error) {
+	// the error pipe closing on exec tells Run that setup went fine
+	syscall.CloseOnExec(errorFd)
+	var c initConfig
+	f := os.NewFile(configFd, "init-config")
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&c); err != nil {
+		return c, fmt.Errorf("reading init config: %w", err)
+	}
+	return c, nil
+}
+
+// waitForParent blocks until Run has placed us in the cgroup and set up
+// networking. The pipe closing without a byte means the parent gave up.
+func waitForParent() error {
+	f := os.NewFile(syncFd, "init-sync")
+	defer f.Close()
+	buf := make([]byte, 1)
+	if _, err := f.Read(buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("runtime exited before the container was set up")
+		}
+		return fmt.Errorf("waiting for runtime: %w", err)
+	}
+	return nil
+}
+
+// fail reports a setup error to Run over the error pipe and exits, so it
+// isn't mistaken for the container's own exit status
+func fail(format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+	f := os.NewFile(errorFd, "init-error")
+	if _, err := f.WriteString(msg); err != nil {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	os.Exit(1)
+}
+
+// readInitError returns the error the init process reported, if any
+func readInitError(r io.Reader) error {
+	msg, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading init error: %w", err)
+	}
+	if len(msg) > 0 {
+		return errors.New(string(msg))
+	}
+	return nil
+}
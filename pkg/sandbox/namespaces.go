@@ -0,0 +1,117 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Namespace is a namespace of the container by its OCI type: pid, network,
+// mount, ipc, uts, user or cgroup. Without Path the container gets a new
+// one, with it the container joins the namespace at Path.
+type Namespace struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+}
+
+var namespaceFlags = map[string]uintptr{
+	"pid":     syscall.CLONE_NEWPID,
+	"network": syscall.CLONE_NEWNET,
+	"mount":   syscall.CLONE_NEWNS,
+	"ipc":     syscall.CLONE_NEWIPC,
+	"uts":     syscall.CLONE_NEWUTS,
+	"user":    syscall.CLONE_NEWUSER,
+	"cgroup":  unix.CLONE_NEWCGROUP,
+}
+
+// ipcSysctls are the sysctls of an ipc namespace besides fs.mqueue.*
+var ipcSysctls = map[string]bool{
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.sem":             true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_rmid_forced": true,
+}
+
+// SysctlNamespace returns the type of namespace sysctl key belongs to. Other
+// sysctls would change the host and are refused.
+func SysctlNamespace(key string) (string, error) {
+	switch {
+	case strings.HasPrefix(key, "net."):
+		return "network", nil
+	case strings.HasPrefix(key, "fs.mqueue.") || ipcSysctls[key]:
+		return "ipc", nil
+	case key == "kernel.hostname" || key == "kernel.domainname":
+		return "uts", nil
+	}
+	return "", fmt.Errorf("sysctl %s is not namespaced", key)
+}
+
+// defaultCloneflags are the namespaces a container gets when Config.Namespaces is nil
+const defaultCloneflags = syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC
+
+// cloneFlags splits namespaces into the ones the init is cloned into and the
+// ones it enters itself once it runs: those joined by path, and a new cgroup
+// namespace, which is only unshared once the init is in its cgroup so that
+// cgroup becomes its root. Go runs init() on the main thread, the one that
+// execs the command, so joining the others there takes. Joining a pid
+// namespace only moves children, and the kernel refuses mount and user
+// namespaces to multi-threaded processes like a Go one.
+func cloneFlags(namespaces []Namespace) (uintptr, []Namespace, error) {
+	var flags uintptr
+	var enter []Namespace
+	seen := map[string]bool{}
+	for _, ns := range namespaces {
+		f, ok := namespaceFlags[ns.Type]
+		if !ok {
+			return 0, nil, fmt.Errorf("unknown namespace type %q", ns.Type)
+		}
+		if seen[ns.Type] {
+			return 0, nil, fmt.Errorf("namespace %s given twice", ns.Type)
+		}
+		seen[ns.Type] = true
+		switch {
+		case ns.Path != "" && (f == syscall.CLONE_NEWPID || f == syscall.CLONE_NEWNS || f == syscall.CLONE_NEWUSER):
+			return 0, nil, fmt.Errorf("joining the %s namespace %s is not supported", ns.Type, ns.Path)
+		case ns.Path != "" || f == unix.CLONE_NEWCGROUP:
+			enter = append(enter, ns)
+		default:
+			flags |= f
+		}
+	}
+	// the container's root is a chroot, it needs mounts of its own
+	if flags&syscall.CLONE_NEWNS == 0 {
+		return 0, nil, errors.New("a container needs a new mount namespace")
+	}
+	return flags, enter, nil
+}
+
+// enterNamespaces joins the namespaces with a path and unshares the others,
+// run by the init before it sets anything up
+func enterNamespaces(namespaces []Namespace) error {
+	for _, ns := range namespaces {
+		f := namespaceFlags[ns.Type]
+		if ns.Path == "" {
+			if err := unix.Unshare(int(f)); err != nil {
+				return fmt.Errorf("unshare %s namespace: %w", ns.Type, err)
+			}
+			continue
+		}
+		fd, err := unix.Open(ns.Path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("open %s namespace: %w", ns.Type, err)
+		}
+		err = unix.Setns(fd, int(f))
+		unix.Close(fd)
+		if err != nil {
+			return fmt.Errorf("join %s namespace %s: %w", ns.Type, ns.Path, err)
+		}
+	}
+	return nil
+}
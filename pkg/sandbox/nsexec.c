@@ -0,0 +1,104 @@
+//go:build cgo
+
+// nsexec joins the namespaces, root and working directory of a running
+// container for Exec. It runs as a constructor, before the Go runtime starts
+// the threads that keep a process from joining mount and user namespaces.
+
+#define _GNU_SOURCE
+#include <errno.h>
+#include <sched.h>
+#include <signal.h>
+#include <stdarg.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/wait.h>
+#include <unistd.h>
+
+// fds and environment Exec sets up, see setns.go
+#define CONFIG_FD 3
+#define SYNC_FD 4
+#define ERROR_FD 5
+#define ROOT_FD 6
+#define CWD_FD 7
+#define SETNS_ENV "_MYRUNTIME_SETNS"
+
+// bail reports a failure over the error pipe the way the Go side does
+static void bail(const char *fmt, ...)
+{
+	char msg[512];
+	va_list ap;
+
+	va_start(ap, fmt);
+	int n = vsnprintf(msg, sizeof(msg), fmt, ap);
+	va_end(ap);
+	if (n < 0)
+		n = 0;
+	if (n >= (int)sizeof(msg))
+		n = sizeof(msg) - 1;
+	if (write(ERROR_FD, msg, n) < 0)
+		fprintf(stderr, "%s\n", msg);
+	_exit(1);
+}
+
+// forward waits for the exec stage and exits the way it did, so Exec sees
+// the command's status
+static void forward(pid_t child)
+{
+	int status;
+
+	close(CONFIG_FD);
+	close(SYNC_FD);
+	close(ERROR_FD);
+	while (waitpid(child, &status, 0) < 0) {
+		if (errno != EINTR)
+			_exit(1);
+	}
+	if (WIFSIGNALED(status)) {
+		signal(WTERMSIG(status), SIG_DFL);
+		kill(getpid(), WTERMSIG(status));
+	}
+	_exit(WEXITSTATUS(status));
+}
+
+// SETNS_ENV lists fd:type of each namespace to join, in order
+__attribute__((constructor)) static void nsexec(void)
+{
+	const char *spec = getenv(SETNS_ENV);
+	if (spec == NULL)
+		return;
+
+	int joined_pid = 0;
+	while (*spec != '\0') {
+		char *end;
+		long fd = strtol(spec, &end, 10);
+		if (end == spec || *end != ':')
+			bail("invalid %s %s", SETNS_ENV, getenv(SETNS_ENV));
+		const char *type = end + 1;
+		size_t len = strcspn(type, ",");
+		if (setns(fd, 0) < 0)
+			bail("join %.*s namespace: %s", (int)len, type, strerror(errno));
+		close(fd);
+		if (len == 3 && strncmp(type, "pid", 3) == 0)
+			joined_pid = 1;
+		spec = type + len;
+		if (*spec == ',')
+			spec++;
+	}
+
+	if (fchdir(ROOT_FD) < 0 || chroot(".") < 0)
+		bail("enter container root: %s", strerror(errno));
+	if (fchdir(CWD_FD) < 0)
+		bail("enter container working directory: %s", strerror(errno));
+	close(ROOT_FD);
+	close(CWD_FD);
+
+	// only children enter a pid namespace
+	if (joined_pid) {
+		pid_t child = fork();
+		if (child < 0)
+			bail("fork: %s", strerror(errno));
+		if (child > 0)
+			forward(child);
+	}
+}
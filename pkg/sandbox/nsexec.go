@@ -0,0 +1,10 @@
+//go:build cgo
+
+// The namespaces of a running container are joined by the constructor in
+// nsexec.c, which has to run before the Go runtime does.
+
+package sandbox
+
+import "C"
+
+const haveNsexec = true
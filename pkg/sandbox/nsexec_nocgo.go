@@ -0,0 +1,6 @@
+//go:build !cgo
+
+package sandbox
+
+// without cgo there is nothing to join a container's namespaces for Exec
+const haveNsexec = false
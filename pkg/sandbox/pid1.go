@@ -0,0 +1,67 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runAsInit starts the container command as a child and stays behind as
+// PID 1: it reaps every process that gets reparented to it and forwards the
+// signals it receives to the command's process group. It returns the exit
+// status of the command, 128+n when signal n killed it. With tty, stdin is
+// made the command's controlling terminal.
+func runAsInit(path string, args, env []string, tty bool) int {
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs)
+
+	proc, err := os.StartProcess(path, args, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys:   &syscall.SysProcAttr{Setsid: true, Setctty: tty, Ctty: 0},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "exec: %q: %v\n", path, err)
+		return execExitCode(err)
+	}
+	// tell Run the command is running
+	os.NewFile(errorFd, "init-error").Close()
+
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGCHLD:
+			if status, done := reap(proc.Pid); done {
+				if status.Signaled() {
+					return 128 + int(status.Signal())
+				}
+				return status.ExitStatus()
+			}
+		case syscall.SIGURG:
+			// used by the Go scheduler, not meant for the container
+		default:
+			// the command leads its own group, anything it started in it gets the signal too
+			if err := syscall.Kill(-proc.Pid, sig.(syscall.Signal)); err != nil && err != syscall.ESRCH {
+				fmt.Fprintf(os.Stderr, "init: forwarding %v: %v\n", sig, err)
+			}
+		}
+	}
+	return 0
+}
+
+// reap collects every exited child. done is set once main has exited.
+func reap(main int) (status syscall.WaitStatus, done bool) {
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if pid <= 0 || err != nil {
+			return status, done
+		}
+		if pid == main {
+			status, done = ws, true
+		}
+	}
+}
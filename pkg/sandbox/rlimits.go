@@ -0,0 +1,122 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Ulimit is one resource limit for the container process
+type Ulimit struct {
+	Name string
+	Soft uint64
+	Hard uint64
+}
+
+func (u Ulimit) String() string {
+	return fmt.Sprintf("%s=%d:%d", u.Name, u.Soft, u.Hard)
+}
+
+var rlimitNames = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// DefaultUlimits apply unless overridden: a soft nofile of 1024 keeps select()
+// users working, the hard limit leaves room for those that raise it.
+var DefaultUlimits = []Ulimit{
+	{Name: "nofile", Soft: 1024, Hard: 524288},
+}
+
+// ParseUlimit parses name=soft[:hard], -1 or "unlimited" meaning no limit
+func ParseUlimit(s string) (Ulimit, error) {
+	name, val, ok := strings.Cut(s, "=")
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !ok {
+		return Ulimit{}, fmt.Errorf("invalid ulimit %q, want name=soft[:hard]", s)
+	}
+	if _, ok := rlimitNames[name]; !ok {
+		return Ulimit{}, fmt.Errorf("unknown ulimit %q", name)
+	}
+	softS, hardS, ok := strings.Cut(val, ":")
+	if !ok {
+		hardS = softS
+	}
+	soft, err := parseLimit(softS)
+	if err != nil {
+		return Ulimit{}, fmt.Errorf("invalid ulimit %q: %v", s, err)
+	}
+	hard, err := parseLimit(hardS)
+	if err != nil {
+		return Ulimit{}, fmt.Errorf("invalid ulimit %q: %v", s, err)
+	}
+	if soft > hard {
+		return Ulimit{}, fmt.Errorf("invalid ulimit %q: soft limit above hard limit", s)
+	}
+	return Ulimit{Name: name, Soft: soft, Hard: hard}, nil
+}
+
+func parseLimit(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "-1" || s == "unlimited" {
+		return unix.RLIM_INFINITY, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// applyUlimits sets the limits, DefaultUlimits first so configured ones win.
+// Raising a hard limit needs CAP_SYS_RESOURCE, so this runs before capabilities
+// are dropped; in a user namespace the defaults are clamped to what we have.
+func applyUlimits(limits []Ulimit) error {
+	for _, d := range DefaultUlimits {
+		var cur unix.Rlimit
+		if err := unix.Getrlimit(rlimitNames[d.Name], &cur); err != nil {
+			return fmt.Errorf("getrlimit %s: %w", d.Name, err)
+		}
+		if d.Hard > cur.Max {
+			err := setUlimit(d)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, unix.EPERM) {
+				return err
+			}
+			d.Hard = cur.Max
+			d.Soft = min(d.Soft, d.Hard)
+		}
+		if err := setUlimit(d); err != nil {
+			return err
+		}
+	}
+	for _, u := range limits {
+		if err := setUlimit(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setUlimit(u Ulimit) error {
+	rl := unix.Rlimit{Cur: u.Soft, Max: u.Hard}
+	if err := unix.Setrlimit(rlimitNames[u.Name], &rl); err != nil {
+		return fmt.Errorf("setrlimit %s: %w", u, err)
+	}
+	return nil
+}
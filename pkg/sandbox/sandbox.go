@@ -1,75 +1,307 @@
 package sandbox
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"myruntime/pkg/cgroup"
+	"myruntime/pkg/fs"
 	"myruntime/pkg/netsetup"
+	"myruntime/pkg/seccomp"
+	"myruntime/pkg/userns"
 
 	"github.com/syndtr/gocapability/capability"
+	"golang.org/x/sys/unix"
 )
 
 // Config describes a container/sandbox
 type Config struct {
-	Name         string
-	Rootfs       string
-	Cmd          *string
-	CgroupPath   string
-	CapAdd       *string
-	CapDrop      *string
+	Name   string
+	Rootfs string
+	// Args is the command and its arguments, looked up in the container's PATH
+	Args       []string
+	CgroupPath string
+	CapAdd     *string
+	CapDrop    *string
+	// Capabilities gives every set of the process instead of CapAdd and
+	// CapDrop when set
+	Capabilities *ProcessCaps
 	Publish      []netsetup.PortMap
 	BridgeName   *string
 	BridgeCIDR   *string
 	WorkDir      string
-	OverlayLower string
-	OverlayUpper string
-	OverlayWork  string
+	Storage      string
+	ReadOnly     bool
+	Tmpfs        []string
+	Etc          netsetup.DNSConfig
+	// Seccomp filters the container's syscalls, nil runs it unconfined
+	Seccomp *seccomp.Profile
+	// NoNewPrivs sets no_new_privs so exec can't gain privileges (setuid, file caps)
+	NoNewPrivs bool
+	// Ulimits override DefaultUlimits
+	Ulimits []Ulimit
+	// OOMScoreAdj is written to oom_score_adj when set
+	OOMScoreAdj *int
+	// TTY gives the container a pseudo-terminal as stdio
+	TTY bool
+	// Interactive attaches stdin, the container reads /dev/null otherwise
+	Interactive bool
+	// Stdin defaults to the runtime's own
+	Stdin *os.File
+	// Resize sets the size of the container's terminal, which otherwise
+	// follows a terminal stdin
+	Resize <-chan WindowSize
+	// Stdout and Stderr default to the runtime's own
+	Stdout *os.File
+	Stderr *os.File
+	// OnStart is called with the init pid and the container's addresses
+	// once the command runs
+	OnStart func(pid int, ips []string)
+	// Init keeps a minimal PID 1 that reaps zombies and forwards signals
+	// instead of running the command as PID 1
+	Init bool
+	// User is name|uid[:group|gid] in the container, root when empty
+	User     string
+	GroupAdd []string
+	// UIDMap and GIDMap put the container in its own user namespace when set
+	UIDMap []userns.IDMap
+	GIDMap []userns.IDMap
+	// StateDir keeps the container's init config for Exec
+	StateDir string
+	// Env replaces the default PATH and TERM when set
+	Env []string
+	// Cwd is the working directory in the container, / when empty
+	Cwd string
+	// Namespaces replace the default pid, network, mount, ipc and uts ones
+	// when set, the hostname is then only set if Etc.Hostname is
+	Namespaces []Namespace
+	// Mounts are mounted in order into the rootfs, they replace the default
+	// mount of /proc, and with Devices the /dev of fs.DevMounts, when set
+	Mounts []fs.Mount
+	// Devices fills /dev with the default device nodes, and ExtraDevices
+	Devices      bool
+	ExtraDevices []fs.Device
+	// Sysctl is written to /proc/sys in the container's namespaces, keys
+	// must pass SysctlNamespace
+	Sysctl map[string]string
+	// MaskedPaths are hidden in the container, ReadonlyPaths made read-only
+	MaskedPaths   []string
+	ReadonlyPaths []string
+	// Gate is a FIFO the init waits at, after setting up the container and
+	// before running the command, until something opens it for reading.
+	// OnCreated is called with the init pid once it waits there; an error
+	// kills the container.
+	Gate      string
+	OnCreated func(pid int) error
+	// ConsoleSocket is a unix socket the master of the container's terminal
+	// is sent to instead of being attached to stdio
+	ConsoleSocket string
 }
 
-func Run(cfg Config) error {
+// Result is how a container ended
+type Result struct {
+	// ExitCode is the exit status, 0 when a signal killed the container
+	ExitCode int
+	Signal   syscall.Signal
+	// OOMKilled is set when the kernel OOM killer hit the container's cgroup
+	OOMKilled bool
+	Duration  time.Duration
+}
+
+// Status is the exit status a CLI should report, 128+n for signal n
+func (r Result) Status() int {
+	if r.Signal != 0 {
+		return 128 + int(r.Signal)
+	}
+	return r.ExitCode
+}
+
+// Run starts the container and waits for it. Failures of the runtime or of
+// the container setup are returned as errors, the command's own exit status
+// is in the Result.
+func Run(cfg Config) (Result, error) {
 	// re-exec self into new namespaces
 	self, err := os.Executable()
 	if err != nil {
-		return err
+		return Result{}, err
 	}
-	// prepare env
-	env := os.Environ()
-	env = append(env, "MYRUNTIME_IS_CHILD=1")
-	env = append(env, "MYRUNTIME_ROOTFS="+cfg.Rootfs)
-	env = append(env, "MYRUNTIME_CMD="+*cfg.Cmd)
-	if cfg.CgroupPath != "" {
-		env = append(env, "MYRUNTIME_CGROUP="+cfg.CgroupPath)
+	if cfg.Etc.Hostname == "" && cfg.Namespaces == nil {
+		cfg.Etc.Hostname = cfg.Name
+	}
+	cloneflags := uintptr(defaultCloneflags)
+	var enter []Namespace
+	if cfg.Namespaces != nil {
+		if cloneflags, enter, err = cloneFlags(cfg.Namespaces); err != nil {
+			return Result{}, err
+		}
 	}
-	if cfg.CapAdd != nil && *cfg.CapAdd != "" {
-		env = append(env, "MYRUNTIME_CAP_ADD="+*cfg.CapAdd)
+	ic := initConfig{
+		Name:          cfg.Name,
+		Rootfs:        cfg.Rootfs,
+		Args:          cfg.Args,
+		ReadOnly:      cfg.ReadOnly,
+		Tmpfs:         cfg.Tmpfs,
+		Hostname:      cfg.Etc.Hostname,
+		Seccomp:       cfg.Seccomp,
+		NoNewPrivs:    cfg.NoNewPrivs,
+		Ulimits:       cfg.Ulimits,
+		OOMScoreAdj:   cfg.OOMScoreAdj,
+		User:          cfg.User,
+		GroupAdd:      cfg.GroupAdd,
+		Init:          cfg.Init,
+		TTY:           cfg.TTY,
+		Namespaces:    enter,
+		Mounts:        cfg.Mounts,
+		Devices:       cfg.Devices,
+		ExtraDevices:  cfg.ExtraDevices,
+		Sysctl:        cfg.Sysctl,
+		MaskedPaths:   cfg.MaskedPaths,
+		ReadonlyPaths: cfg.ReadonlyPaths,
+		Cwd:           cfg.Cwd,
+		Gate:          cfg.Gate,
 	}
-	if cfg.CapDrop != nil && *cfg.CapDrop != "" {
-		env = append(env, "MYRUNTIME_CAP_DROP="+*cfg.CapDrop)
+	if cfg.CapAdd != nil {
+		ic.CapAdd = *cfg.CapAdd
 	}
-	if cfg.BridgeName != nil {
-		env = append(env, "MYRUNTIME_BRIDGE="+*cfg.BridgeName)
+	if cfg.CapDrop != nil {
+		ic.CapDrop = *cfg.CapDrop
 	}
-	if cfg.BridgeCIDR != nil {
-		env = append(env, "MYRUNTIME_BRIDGE_CIDR="+*cfg.BridgeCIDR)
+	ic.Capabilities = cfg.Capabilities
+	if cfg.StateDir != "" {
+		if err := saveInitConfig(cfg.StateDir, ic); err != nil {
+			return Result{}, err
+		}
+	}
+	if cfg.WorkDir != "" {
+		if err := netsetup.WriteEtcFiles(cfg.WorkDir, cfg.Etc, ""); err != nil {
+			return Result{}, fmt.Errorf("generating /etc files: %w", err)
+		}
+		ic.EtcDir = cfg.WorkDir
+	}
+
+	// config and sync pipes run to the init process, the error pipe back
+	var pipes [3][2]*os.File
+	for i := range pipes {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return Result{}, err
+		}
+		defer r.Close()
+		defer w.Close()
+		pipes[i] = [2]*os.File{r, w}
+	}
+	configR, configW := pipes[0][0], pipes[0][1]
+	syncR, syncW := pipes[1][0], pipes[1][1]
+	errR, errW := pipes[2][0], pipes[2][1]
+	initFiles := []*os.File{configR, syncR, errW}
+	var readyR *os.File
+	if cfg.Gate != "" {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return Result{}, err
+		}
+		defer r.Close()
+		readyR = r
+		initFiles = append(initFiles, w)
 	}
 
-	cmd := exec.Command(self)
-	cmd.Env = env
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
+	cmd := &exec.Cmd{Path: self, Args: []string{initArg0}}
+	// no host environment reaches the container
+	cmd.Env = []string{"PATH=" + DefaultPath, "TERM=xterm"}
+	if cfg.Env != nil {
+		cmd.Env = cfg.Env
+	}
+	stdin, stdout := os.Stdin, os.Stdout
+	if cfg.Stdin != nil {
+		stdin = cfg.Stdin
+	}
+	if cfg.Stdout != nil {
+		stdout = cfg.Stdout
+	}
+	cmd.Stdout = stdout
 	cmd.Stderr = os.Stderr
+	if cfg.Stderr != nil {
+		cmd.Stderr = cfg.Stderr
+	}
+	if cfg.Interactive {
+		cmd.Stdin = stdin
+	}
+	var master, slave *os.File
+	if cfg.TTY {
+		if master, slave, err = openPty(); err != nil {
+			return Result{}, err
+		}
+		defer master.Close()
+		defer slave.Close()
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	}
+	cmd.ExtraFiles = initFiles
+	// A session of its own keeps terminal signals away from the container,
+	// they are forwarded below so they arrive exactly once
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC,
+		Setsid:     true,
+		Cloneflags: cloneflags,
+	}
+	// with -init the terminal belongs to the command's session, not to PID 1
+	if cfg.TTY && !cfg.Init {
+		cmd.SysProcAttr.Setctty = true
+		cmd.SysProcAttr.Ctty = 0
+	}
+	if len(cfg.UIDMap) > 0 {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = userns.SysProcIDMap(cfg.UIDMap)
+		cmd.SysProcAttr.GidMappings = userns.SysProcIDMap(cfg.GIDMap)
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = true
 	}
 
-	if err := cmd.Start(); err != nil {
-		return err
+	err = cmd.Start()
+	for _, f := range initFiles {
+		f.Close()
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	if slave != nil {
+		slave.Close()
+		// sized before the command starts
+		if IsTerminal(stdin) {
+			copyWinsize(stdin, master)
+		}
+	}
+	started := time.Now()
+	// abort kills an init that hasn't been released yet, preferring the
+	// error it reported itself
+	abort := func(err error) (Result, error) {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if ierr := readInitError(errR); ierr != nil {
+			return Result{}, ierr
+		}
+		return Result{}, err
+	}
+	if err := writeInitConfig(configW, ic); err != nil {
+		return abort(err)
+	}
+	// whoever listens on the console socket does the copying
+	if master != nil && cfg.ConsoleSocket != "" {
+		if err := sendConsole(cfg.ConsoleSocket, master); err != nil {
+			return abort(err)
+		}
+		master.Close()
+		master = nil
 	}
 
 	// If cgroup is present, add child to cgroup
@@ -81,189 +313,386 @@ func Run(cfg Config) error {
 	}
 
 	// If networking publish mappings exist, create veths and iptables rules
+	var ips []string
 	for _, p := range cfg.Publish {
 		contIP, err := netsetup.SetupVethAndPortBinding(cmd.Process.Pid, *cfg.BridgeName, *cfg.BridgeCIDR, p)
 		if err != nil {
 			log.Printf("network setup failed for publish %v: %v", p, err)
 		} else {
 			log.Printf("port %d forwarded to container %s:%d", p.HostPort, contIP, p.ContainerPort)
+			if !slices.Contains(ips, contIP) {
+				ips = append(ips, contIP)
+			}
+			if cfg.WorkDir != "" {
+				netsetup.WriteHosts(cfg.WorkDir, cfg.Etc, contIP)
+			}
+		}
+	}
+
+	// let the container go on
+	if _, err := syncW.Write([]byte{1}); err != nil {
+		return abort(fmt.Errorf("releasing container: %w", err))
+	}
+	syncW.Close()
+
+	// a gated init reports when it is set up and when the gate opened;
+	// the pipe closing before either means it failed or was killed
+	opened := true
+	if readyR != nil {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(readyR, b); err != nil {
+			return abort(errors.New("container init exited during setup"))
+		}
+		if cfg.OnCreated != nil {
+			if err := cfg.OnCreated(cmd.Process.Pid); err != nil {
+				return abort(err)
+			}
 		}
+		_, err := io.ReadFull(readyR, b)
+		opened = err == nil && b[0] == gateOpened
+	}
+
+	var output chan struct{}
+	if master != nil {
+		var restore func()
+		output, restore = attachPty(master, stdin, stdout, cfg.Interactive)
+		defer restore()
+		if cfg.Resize != nil {
+			go func() {
+				for ws := range cfg.Resize {
+					setWinsize(master, ws)
+				}
+			}()
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGWINCH)
+	defer signal.Stop(sigs)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGWINCH {
+				if master != nil {
+					copyWinsize(stdin, master)
+				}
+				continue
+			}
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	// exec closes the error pipe, anything on it is a setup failure
+	ierr := readInitError(errR)
+	if ierr == nil && opened && cfg.OnStart != nil {
+		cfg.OnStart(cmd.Process.Pid, ips)
 	}
 
-	if err := cmd.Wait(); err != nil {
-		return err
+	err = cmd.Wait()
+	if output != nil {
+		<-output
 	}
-	return nil
+	res := Result{Duration: time.Since(started)}
+	if ierr != nil {
+		return res, ierr
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return res, err
+	}
+	status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if status.Signaled() {
+		res.Signal = status.Signal()
+	} else {
+		res.ExitCode = status.ExitStatus()
+	}
+	if cfg.CgroupPath != "" {
+		res.OOMKilled = cgroup.OOMKilled(cfg.CgroupPath)
+	}
+	return res, nil
 }
 
-// childMain is executed when process is re-exec'd with MYRUNTIME_IS_CHILD=1
+// init runs the container setup when the runtime is re-executed by Run, or
+// the exec stage when Exec re-executes it inside a running container
 func init() {
-	if os.Getenv("MYRUNTIME_IS_CHILD") != "1" {
+	if os.Args[0] == execArg0 {
+		runExecStage()
+	}
+	if os.Args[0] != initArg0 {
 		return
 	}
-	// child execution
-	rootfs := os.Getenv("MYRUNTIME_ROOTFS")
-	cmdline := os.Getenv("MYRUNTIME_CMD")
-	cg := os.Getenv("MYRUNTIME_CGROUP")
-	capAdd := os.Getenv("MYRUNTIME_CAP_ADD")
-	capDrop := os.Getenv("MYRUNTIME_CAP_DROP")
-	bridge := os.Getenv("MYRUNTIME_BRIDGE")
-	bridgeCIDR := os.Getenv("MYRUNTIME_BRIDGE_CIDR")
-
-	// Mount proc
-	procPath := filepath.Join(rootfs, "proc")
-	if err := os.MkdirAll(procPath, 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "warn: failed to create proc dir: %v\n", err)
+	cfg, err := readInitConfig()
+	if err != nil {
+		fail("%v", err)
+	}
+	if err := waitForParent(); err != nil {
+		fail("%v", err)
 	}
-	if err := syscall.Mount("proc", procPath, "proc", 0, ""); err != nil {
-		fmt.Fprintf(os.Stderr, "warn mount proc: %v\n", err)
+	if err := enterNamespaces(cfg.Namespaces); err != nil {
+		fail("%v", err)
 	}
+	rootfs := cfg.Rootfs
 
-	// chroot
-	if err := syscall.Chroot(rootfs); err != nil {
-		fmt.Fprintf(os.Stderr, "chroot failed: %v\n", err)
-		os.Exit(1)
+	// keep our mounts out of the host namespace
+	if err := fs.MakePrivate(); err != nil {
+		fmt.Fprintf(os.Stderr, "warn: %v\n", err)
+	}
+
+	// Mount proc, unless the mounts given do
+	if cfg.Mounts == nil {
+		if err := fs.MountInto(rootfs, fs.Mount{Destination: "/proc", Type: "proc", Source: "proc"}); err != nil {
+			fmt.Fprintf(os.Stderr, "warn: %v\n", err)
+		}
 	}
-	if err := os.Chdir("/"); err != nil {
-		fmt.Fprintf(os.Stderr, "chdir failed: %v\n", err)
-		os.Exit(1)
+	for _, m := range cfg.Mounts {
+		if err := fs.MountInto(rootfs, m); err != nil {
+			fail("%v", err)
+		}
 	}
 
-	// join cgroup if any
-	if cg != "" {
-		if err := os.WriteFile(filepath.Join(cg, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
-			fmt.Fprintf(os.Stderr, "warn join cgroup: %v\n", err)
+	// tmpfs mounts; mountpoints are created before the rootfs goes read-only.
+	// They go before /dev is filled, so one on /dev gets the devices too.
+	var tmpfs []fs.Tmpfs
+	tmpfsAt := map[string]bool{}
+	for _, spec := range cfg.Tmpfs {
+		t, err := fs.ParseTmpfs(spec)
+		if err != nil {
+			fail("invalid tmpfs %s: %v", spec, err)
+		}
+		tmpfs = append(tmpfs, t)
+		tmpfsAt[filepath.Clean(t.Destination)] = true
+	}
+	// without mounts given /dev gets the mounts of fs.DevMounts, tmpfs ones
+	// asked for take their place
+	defaultDev := cfg.Devices && cfg.Mounts == nil
+	if defaultDev && !tmpfsAt["/dev"] {
+		if err := fs.MountInto(rootfs, fs.DevMounts[0]); err != nil {
+			fail("%v", err)
+		}
+	}
+	for _, t := range tmpfs {
+		if err := fs.MountTmpfs(rootfs, t); err != nil {
+			fail("%v", err)
+		}
+	}
+	for _, m := range fs.DevMounts[1:] {
+		if defaultDev && !tmpfsAt[m.Destination] {
+			if err := fs.MountInto(rootfs, m); err != nil {
+				fail("%v", err)
+			}
+		}
+	}
+	if cfg.Devices {
+		if err := fs.MountDevices(rootfs, cfg.ExtraDevices); err != nil {
+			fail("%v", err)
+		}
+		// the terminal is the container's console; bound by path, its fd
+		// refers to the runtime's mount namespace
+		if cfg.TTY {
+			pts, err := os.Readlink("/proc/self/fd/0")
+			if err == nil {
+				err = fs.BindFile(rootfs, pts, "/dev/console")
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warn: %v\n", err)
+			}
 		}
 	}
 
-	// Setup network interface inside container namespace if env tells parent to create veths (parent will run nsenter commands)
-	if bridge != "" && bridgeCIDR != "" {
-		// nothing to do here beyond expecting the host to move a veth and set IP/route via nsenter
+	// generated hostname, hosts and resolv.conf stay writable like Docker's
+	if cfg.EtcDir != "" {
+		for _, name := range netsetup.EtcFiles {
+			if err := fs.BindFile(rootfs, filepath.Join(cfg.EtcDir, name), filepath.Join("/etc", name)); err != nil {
+				fmt.Fprintf(os.Stderr, "warn: %v\n", err)
+			}
+		}
+	}
+	if cfg.Hostname != "" {
+		if err := syscall.Sethostname([]byte(cfg.Hostname)); err != nil {
+			fmt.Fprintf(os.Stderr, "warn: set hostname: %v\n", err)
+		}
 	}
 
-	// Apply capabilities safely
-	if capAdd != "" || capDrop != "" {
-		capsAdd := parseCapsOrEmpty(capAdd)
-		capsDrop := parseCapsOrEmpty(capDrop)
+	// through the container's /proc, which the namespaces it is in decide
+	for key, val := range cfg.Sysctl {
+		path := "/proc/sys/" + strings.ReplaceAll(key, ".", "/")
+		if err := fs.WriteFileInRoot(rootfs, path, []byte(val)); err != nil {
+			fail("sysctl %s: %v", key, err)
+		}
+	}
 
-		capset, err := capability.NewPid2(0)
+	if cfg.Cwd != "" {
+		dir, err := fs.MkdirInRoot(rootfs, cfg.Cwd)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to load capabilities: %v\n", err)
-			os.Exit(1)
+			fail("create working directory: %v", err)
+		}
+		dir.Close()
+	}
+	for _, p := range cfg.MaskedPaths {
+		if err := fs.MaskPath(rootfs, p); err != nil {
+			fail("%v", err)
+		}
+	}
+	for _, p := range cfg.ReadonlyPaths {
+		if err := fs.ReadonlyPath(rootfs, p); err != nil {
+			fail("%v", err)
 		}
+	}
 
-		// Clear all sets
-		capset.Clear(capability.EFFECTIVE)
-		capset.Clear(capability.PERMITTED)
-		capset.Clear(capability.INHERITABLE)
+	if cfg.ReadOnly {
+		if err := fs.RemountReadOnly(rootfs); err != nil {
+			fail("%v", err)
+		}
+	}
 
-		// Add requested caps
-		for _, c := range capsAdd {
-			capset.Set(capability.EFFECTIVE, c)
-			capset.Set(capability.PERMITTED, c)
-			capset.Set(capability.INHERITABLE, c)
+	// the notify agent lives on the host side of the chroot
+	profile := cfg.Seccomp
+	var listener *net.UnixConn
+	if profile != nil && profile.ListenerPath != "" {
+		if listener, err = seccomp.DialListener(profile.ListenerPath); err != nil {
+			fail("%v", err)
 		}
+	}
 
-		// Drop requested caps (just in case they were in defaults)
-		for _, c := range capsDrop {
-			capset.Unset(capability.EFFECTIVE, c)
-			capset.Unset(capability.PERMITTED, c)
-			capset.Unset(capability.INHERITABLE, c)
+	// the gate is outside the root, keep a handle to reopen it from inside
+	gate := -1
+	if cfg.Gate != "" {
+		if gate, err = unix.Open(cfg.Gate, unix.O_PATH|unix.O_CLOEXEC, 0); err != nil {
+			fail("open gate: %v", err)
 		}
+	}
 
-		// Restrict bounding set to final caps (important!)
-		capset.Apply(capability.BOUNDS)
+	// chroot
+	if err := syscall.Chroot(rootfs); err != nil {
+		fail("chroot failed: %v", err)
+	}
+	if err := os.Chdir(cmp.Or(cfg.Cwd, "/")); err != nil {
+		fail("chdir failed: %v", err)
+	}
+	if gate >= 0 {
+		waitAtGate(gate)
+	}
+	startCommand(cfg, listener)
+}
 
-		// Finally apply all sets
-		if err := capset.Apply(capability.CAPS); err != nil {
-			fmt.Fprintf(os.Stderr, "failed to apply capabilities: %v\n", err)
-			os.Exit(1)
+// waitAtGate tells Run the container is set up and blocks until something
+// opens the gate FIFO for reading. The FIFO is reopened through /proc, the
+// kernel only checks the FIFO's own permissions then.
+func waitAtGate(gate int) {
+	syscall.CloseOnExec(readyFd)
+	ready := os.NewFile(readyFd, "init-ready")
+	if _, err := ready.Write([]byte{gateWaiting}); err != nil {
+		fail("reporting setup: %v", err)
+	}
+	fd, err := unix.Open(fmt.Sprintf("/proc/self/fd/%d", gate), unix.O_WRONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		fail("open gate: %v", err)
+	}
+	unix.Write(fd, []byte{0})
+	unix.Close(fd)
+	unix.Close(gate)
+	ready.Write([]byte{gateOpened})
+	ready.Close()
+}
+
+// startCommand applies the container's user, limits and security profile
+// to the process, inside the container's root, and execs the command
+func startCommand(cfg initConfig, listener *net.UnixConn) {
+	caps, err := ResolveCaps(cfg.CapAdd, cfg.CapDrop)
+	if cfg.Capabilities != nil {
+		caps, err = ResolveProcessCaps(*cfg.Capabilities)
+	}
+	if err != nil {
+		fail("%v", err)
+	}
+	// users and groups come from the image, not the host
+	user, err := ResolveUser(cfg.User, cfg.GroupAdd, "/etc/passwd", "/etc/group")
+	if err != nil {
+		fail("%v", err)
+	}
+
+	// raising hard limits and lowering oom_score_adj need CAP_SYS_RESOURCE,
+	// which the container may not keep
+	if err := applyUlimits(cfg.Ulimits); err != nil {
+		fail("%v", err)
+	}
+	if cfg.OOMScoreAdj != nil {
+		if err := os.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(*cfg.OOMScoreAdj)), 0644); err != nil {
+			fail("set oom_score_adj: %v", err)
+		}
+	}
+
+	if cfg.NoNewPrivs {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			fail("set no_new_privs: %v", err)
 		}
 	}
 
-	args := strings.Fields(cmdline)
+	// Loading a filter without no_new_privs needs CAP_SYS_ADMIN, so when the
+	// container drops it the filter goes in before capabilities are applied.
+	// Otherwise it is the last thing before exec.
+	profile := cfg.Seccomp
+	var prog *seccomp.Program
+	seccompLoaded := false
+	if profile != nil {
+		if prog, err = seccomp.Compile(profile, caps.Names()); err != nil {
+			fail("%v", err)
+		}
+		if !cfg.NoNewPrivs && !caps.Has(capability.CAP_SYS_ADMIN) {
+			installSeccomp(prog, listener, cfg.Name)
+			seccompLoaded = true
+		}
+	}
+
+	// the bounding set needs CAP_SETPCAP and setuid clears the effective set,
+	// so drop bounding caps as root, switch user, then set the rest
+	if err := applyBoundingCaps(caps); err != nil {
+		fail("%v", err)
+	}
+	if err := switchUser(user); err != nil {
+		fail("%v", err)
+	}
+	if err := applyCaps(caps); err != nil {
+		fail("%v", err)
+	}
+
+	args := cfg.Args
 	if len(args) == 0 {
 		os.Exit(0)
 	}
 
-	// Set up a minimal environment
-	env := []string{
-		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-		"TERM=xterm",
+	env := os.Environ()
+	if os.Getenv("HOME") == "" {
+		env = append(env, "HOME="+user.Home)
 	}
 
-	// Use the full path to the command if it's not already absolute
-	cmdPath := args[0]
-	if !filepath.IsAbs(cmdPath) {
-		cmdPath = "/bin/" + cmdPath
+	cmdPath, err := lookPath(args[0], os.Getenv("PATH"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(execExitCode(err))
 	}
 
-	// Replace the command in args with the full path
-	args[0] = cmdPath
+	if prog != nil && !seccompLoaded {
+		installSeccomp(prog, listener, cfg.Name)
+	}
 
+	if cfg.Init {
+		os.Exit(runAsInit(cmdPath, args, env, cfg.TTY))
+	}
 	if err := syscall.Exec(cmdPath, args, env); err != nil {
-		fmt.Fprintf(os.Stderr, "exec failed: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "exec: %q: %v\n", cmdPath, err)
+		os.Exit(execExitCode(err))
 	}
 }
 
-var capNames = map[string]capability.Cap{
-	"CAP_CHOWN":              capability.CAP_CHOWN,
-	"CAP_DAC_OVERRIDE":       capability.CAP_DAC_OVERRIDE,
-	"CAP_DAC_READ_SEARCH":    capability.CAP_DAC_READ_SEARCH,
-	"CAP_FOWNER":             capability.CAP_FOWNER,
-	"CAP_FSETID":             capability.CAP_FSETID,
-	"CAP_KILL":               capability.CAP_KILL,
-	"CAP_SETGID":             capability.CAP_SETGID,
-	"CAP_SETUID":             capability.CAP_SETUID,
-	"CAP_NET_BIND_SERVICE":   capability.CAP_NET_BIND_SERVICE,
-	"CAP_NET_ADMIN":          capability.CAP_NET_ADMIN,
-	"CAP_SYS_PTRACE":         capability.CAP_SYS_PTRACE,
-	"CAP_SYS_ADMIN":          capability.CAP_SYS_ADMIN,
-	"CAP_SYS_MODULE":         capability.CAP_SYS_MODULE,
-	"CAP_SYS_RAWIO":          capability.CAP_SYS_RAWIO,
-	"CAP_SYS_CHROOT":         capability.CAP_SYS_CHROOT,
-	"CAP_SYS_NICE":           capability.CAP_SYS_NICE,
-	"CAP_SYS_PACCT":          capability.CAP_SYS_PACCT,
-	"CAP_SYS_BOOT":           capability.CAP_SYS_BOOT,
-	"CAP_SYS_TIME":           capability.CAP_SYS_TIME,
-	"CAP_SYS_TTY_CONFIG":     capability.CAP_SYS_TTY_CONFIG,
-	"CAP_SETPCAP":            capability.CAP_SETPCAP,
-	"CAP_SYSLOG":             capability.CAP_SYSLOG,
-	"CAP_AUDIT_WRITE":        capability.CAP_AUDIT_WRITE,
-	"CAP_AUDIT_CONTROL":      capability.CAP_AUDIT_CONTROL,
-	"CAP_SETFCAP":            capability.CAP_SETFCAP,
-	"CAP_MAC_OVERRIDE":       capability.CAP_MAC_OVERRIDE,
-	"CAP_MAC_ADMIN":          capability.CAP_MAC_ADMIN,
-	"CAP_PERFMON":            capability.CAP_PERFMON,
-	"CAP_BPF":                capability.CAP_BPF,
-	"CAP_CHECKPOINT_RESTORE": capability.CAP_CHECKPOINT_RESTORE,
-}
-
-func parseCapsOrEmpty(s string) []capability.Cap {
-	if strings.TrimSpace(s) == "" {
-		return nil
+func installSeccomp(prog *seccomp.Program, listener *net.UnixConn, id string) {
+	fd, err := seccomp.Install(prog)
+	if err != nil {
+		fail("%v", err)
 	}
-
-	seen := map[capability.Cap]bool{}
-	var out []capability.Cap
-
-	for _, p := range strings.Split(s, ",") {
-		p = strings.TrimSpace(strings.ToUpper(p))
-		if p == "" {
-			continue
-		}
-		if !strings.HasPrefix(p, "CAP_") {
-			p = "CAP_" + p
-		}
-		if c, ok := capNames[p]; ok {
-			if !seen[c] {
-				out = append(out, c)
-				seen[c] = true
-			}
-		} else {
-			fmt.Fprintf(os.Stderr, "warn: unknown capability %s\n", p)
-		}
+	if fd < 0 {
+		return
+	}
+	if err := seccomp.SendListener(listener, fd, id, ""); err != nil {
+		fail("%v", err)
 	}
-	return out
 }
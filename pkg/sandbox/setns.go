@@ -0,0 +1,235 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// execArg0 marks the runtime re-executed by Exec inside a running container
+const execArg0 = "myruntime-exec"
+
+// fds the exec stage inherits besides the init's config, sync and error
+// pipes: the init's root and working directory, then the namespaces to join
+const (
+	rootFd = 6
+	cwdFd  = 7
+)
+
+// setnsEnv lists fd:type of the namespaces the constructor in nsexec.c joins
+const setnsEnv = "_MYRUNTIME_SETNS"
+
+// joinOrder is the order Exec joins namespaces in by their /proc name: the
+// user namespace first for the privilege over the others, mount last as it
+// changes the root
+var joinOrder = []string{"user", "cgroup", "ipc", "uts", "net", "pid", "mnt"}
+
+// sameNamespace reports whether pid shares namespace ns with us. Joining it
+// would change nothing, and fails without privilege over its owner.
+func sameNamespace(pid int, ns string) bool {
+	theirs, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", pid, ns))
+	if err != nil {
+		return false
+	}
+	ours, err := os.Readlink("/proc/self/ns/" + ns)
+	return err == nil && ours == theirs
+}
+
+// ExecConfig describes a process started in a running container
+type ExecConfig struct {
+	// Pid is the container's init, whose namespaces are joined
+	Pid int
+	// StateDir is the Config.StateDir the container was run with
+	StateDir   string
+	CgroupPath string
+	Args       []string
+	// User overrides the container's user when set
+	User string
+	// Env is added to the container's environment
+	Env         []string
+	TTY         bool
+	Interactive bool
+}
+
+// Exec runs a command in a running container and waits for it. A
+// multi-threaded process can't join mount or user namespaces, so the runtime
+// is executed again and joins the init's namespaces and root in nsexec.c
+// before its Go runtime starts. It then applies the container's user, limits,
+// capabilities and seccomp profile the way the init did.
+func Exec(cfg ExecConfig) (Result, error) {
+	if !haveNsexec {
+		return Result{}, errors.New("exec: the runtime was built without cgo")
+	}
+	ic, err := loadInitConfig(cfg.StateDir)
+	if err != nil {
+		return Result{}, err
+	}
+	ic.Args = cfg.Args
+	if cfg.User != "" {
+		ic.User = cfg.User
+	}
+	ic.TTY = cfg.TTY
+	ic.Init = false
+	if ic.Seccomp != nil && ic.Seccomp.ListenerPath != "" {
+		return Result{}, errors.New("exec: seccomp profiles with a listenerPath are not supported")
+	}
+
+	// config pipe to the exec stage; it reports on the sync pipe that it got
+	// into the container and on the error pipe how setup went
+	var pipes [3][2]*os.File
+	for i := range pipes {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return Result{}, err
+		}
+		defer r.Close()
+		defer w.Close()
+		pipes[i] = [2]*os.File{r, w}
+	}
+	configR, configW := pipes[0][0], pipes[0][1]
+	syncR, syncW := pipes[1][0], pipes[1][1]
+	errR, errW := pipes[2][0], pipes[2][1]
+	stageFiles := []*os.File{configR, syncW, errW}
+	for _, name := range []string{"root", "cwd"} {
+		f, err := os.Open(fmt.Sprintf("/proc/%d/%s", cfg.Pid, name))
+		if err != nil {
+			return Result{}, err
+		}
+		defer f.Close()
+		stageFiles = append(stageFiles, f)
+	}
+	var joins []string
+	for _, ns := range joinOrder {
+		if sameNamespace(cfg.Pid, ns) {
+			continue
+		}
+		f, err := os.Open(fmt.Sprintf("/proc/%d/ns/%s", cfg.Pid, ns))
+		if err != nil {
+			return Result{}, fmt.Errorf("open %s namespace: %w", ns, err)
+		}
+		defer f.Close()
+		joins = append(joins, fmt.Sprintf("%d:%s", 3+len(stageFiles), ns))
+		stageFiles = append(stageFiles, f)
+	}
+
+	cmd := &exec.Cmd{Path: "/proc/self/exe", Args: []string{execArg0}}
+	cmd.Env = append([]string{"PATH=" + DefaultPath, "TERM=xterm"}, cfg.Env...)
+	cmd.Env = append(cmd.Env, setnsEnv+"="+strings.Join(joins, ","))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if cfg.Interactive {
+		cmd.Stdin = os.Stdin
+	}
+	var master, slave *os.File
+	if cfg.TTY {
+		if master, slave, err = openPty(); err != nil {
+			return Result{}, err
+		}
+		defer master.Close()
+		defer slave.Close()
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	}
+	cmd.ExtraFiles = stageFiles
+	// the exec stage is cloned straight into the container's cgroup, the
+	// runtime stays out of its limits, freezer and kill. Joining later would
+	// miss the child nsexec.c forks for a pid namespace.
+	if cfg.CgroupPath != "" {
+		cg, err := os.Open(cfg.CgroupPath)
+		if err != nil {
+			return Result{}, fmt.Errorf("opening cgroup: %w", err)
+		}
+		defer cg.Close()
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cg.Fd())
+	}
+
+	err = cmd.Start()
+	for _, f := range stageFiles[:3] {
+		f.Close()
+	}
+	if err != nil {
+		return Result{}, fmt.Errorf("starting exec stage: %w", err)
+	}
+	if slave != nil {
+		slave.Close()
+		if IsTerminal(os.Stdin) {
+			copyWinsize(os.Stdin, master)
+		}
+	}
+	started := time.Now()
+	err = writeInitConfig(configW, ic)
+	if err == nil {
+		_, err = io.ReadFull(syncR, make([]byte, 1))
+	}
+	if err != nil {
+		// what failed to join reports why on the error pipe
+		cmd.Process.Kill()
+		cmd.Wait()
+		if ierr := readInitError(errR); ierr != nil {
+			return Result{}, ierr
+		}
+		return Result{}, fmt.Errorf("entering the namespaces of %d: %w", cfg.Pid, err)
+	}
+
+	var output chan struct{}
+	if master != nil {
+		var restore func()
+		output, restore = attachPty(master, os.Stdin, os.Stdout, cfg.Interactive)
+		defer restore()
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGWINCH)
+		defer signal.Stop(sigs)
+		go func() {
+			for range sigs {
+				copyWinsize(os.Stdin, master)
+			}
+		}()
+	}
+
+	ierr := readInitError(errR)
+	err = cmd.Wait()
+	if output != nil {
+		<-output
+	}
+	res := Result{Duration: time.Since(started)}
+	if ierr != nil {
+		return res, ierr
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return res, err
+	}
+	// the exec stage is the command, or passes on its status after a fork
+	status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if status.Signaled() {
+		res.Signal = status.Signal()
+	} else {
+		res.ExitCode = status.ExitStatus()
+	}
+	return res, nil
+}
+
+// runExecStage runs inside the container's namespaces and root, entered by
+// nsexec.c, and execs the command
+func runExecStage() {
+	os.Unsetenv(setnsEnv)
+	sync := os.NewFile(syncFd, "exec-sync")
+	sync.Write([]byte{1})
+	sync.Close()
+	cfg, err := readInitConfig()
+	if err != nil {
+		fail("%v", err)
+	}
+	startCommand(cfg, nil)
+}
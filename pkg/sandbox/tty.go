@@ -0,0 +1,150 @@
+package sandbox
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPty allocates a pseudo-terminal. The slave becomes the container's
+// stdio and controlling terminal, the runtime keeps the master.
+func openPty() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open pty: %w", err)
+	}
+	var n int
+	err = control(master, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return fmt.Errorf("unlock pty: %w", err)
+		}
+		n, err = unix.IoctlGetInt(fd, unix.TIOCGPTN)
+		return err
+	})
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("open pty slave: %w", err)
+	}
+	return master, slave, nil
+}
+
+// control runs fn on the fd of f without switching it to blocking mode
+func control(f *os.File, fn func(fd int) error) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) { ferr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// IsTerminal reports whether f is a terminal
+func IsTerminal(f *os.File) bool {
+	return control(f, func(fd int) error {
+		_, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+		return err
+	}) == nil
+}
+
+// MakeRaw puts the terminal f in raw mode like cfmakeraw, so keys such as
+// ^C reach the container's terminal instead of signalling the runtime
+func MakeRaw(f *os.File) (restore func(), err error) {
+	var old unix.Termios
+	err = control(f, func(fd int) error {
+		t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+		if err != nil {
+			return err
+		}
+		old = *t
+		t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		t.Oflag &^= unix.OPOST
+		t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		t.Cflag &^= unix.CSIZE | unix.PARENB
+		t.Cflag |= unix.CS8
+		t.Cc[unix.VMIN] = 1
+		t.Cc[unix.VTIME] = 0
+		return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("set raw mode: %w", err)
+	}
+	return func() {
+		control(f, func(fd int) error { return unix.IoctlSetTermios(fd, unix.TCSETS, &old) })
+	}, nil
+}
+
+// WindowSize is the size of a terminal in characters
+type WindowSize struct {
+	Rows, Cols uint16
+}
+
+func setWinsize(f *os.File, ws WindowSize) error {
+	return control(f, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{Row: ws.Rows, Col: ws.Cols})
+	})
+}
+
+// copyWinsize resizes the terminal to to match from
+func copyWinsize(from, to *os.File) error {
+	var ws *unix.Winsize
+	err := control(from, func(fd int) (err error) {
+		ws, err = unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return control(to, func(fd int) error { return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, ws) })
+}
+
+// attachPty copies the container's terminal output to stdout and, when
+// interactive, stdin to it. A terminal stdin is switched to raw mode until
+// restore. output is closed once the container's side is gone.
+func attachPty(master, stdin, stdout *os.File, interactive bool) (output chan struct{}, restore func()) {
+	output = make(chan struct{})
+	go func() {
+		// ends with EIO once every process holding the slave is gone
+		io.Copy(stdout, master)
+		close(output)
+	}()
+	restore = func() {}
+	if interactive {
+		go io.Copy(master, stdin)
+	}
+	if interactive && IsTerminal(stdin) {
+		var err error
+		if restore, err = MakeRaw(stdin); err != nil {
+			log.Printf("warn: %v", err)
+			restore = func() {}
+		}
+	}
+	return output, restore
+}
+
+// sendConsole passes the terminal master to the process listening on the
+// unix socket at path, the way runc's --console-socket does
+func sendConsole(path string, master *os.File) error {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("console socket: %w", err)
+	}
+	defer conn.Close()
+	rights := unix.UnixRights(int(master.Fd()))
+	if _, _, err := conn.WriteMsgUnix([]byte(master.Name()), rights, nil); err != nil {
+		return fmt.Errorf("console socket: sending terminal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package sandbox
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ExecUser is who the container process runs as
+type ExecUser struct {
+	UID    int
+	GID    int
+	Groups []int
+	Home   string
+}
+
+type passwdEntry struct {
+	name string
+	uid  int
+	gid  int
+	home string
+}
+
+type groupEntry struct {
+	name    string
+	gid     int
+	members []string
+}
+
+// ResolveUser resolves a name|uid[:group|gid] spec and extra groups against
+// the passwd and group files, like Docker does against the image's /etc.
+// Numeric ids don't need an entry; names do. Without a group the user's
+// primary group and the groups listing it as a member are used.
+func ResolveUser(spec string, groupAdd []string, passwdPath, groupPath string) (ExecUser, error) {
+	users, err := readPasswd(passwdPath)
+	if err != nil {
+		return ExecUser{}, err
+	}
+	groups, err := readGroup(groupPath)
+	if err != nil {
+		return ExecUser{}, err
+	}
+
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	if userPart == "" {
+		userPart = "0"
+	}
+	u := ExecUser{Home: "/"}
+	var entry *passwdEntry
+	if id, err := strconv.Atoi(userPart); err == nil {
+		if id < 0 {
+			return ExecUser{}, fmt.Errorf("invalid user %q", userPart)
+		}
+		u.UID = id
+		for i := range users {
+			if users[i].uid == id {
+				entry = &users[i]
+				break
+			}
+		}
+	} else {
+		for i := range users {
+			if users[i].name == userPart {
+				entry = &users[i]
+				break
+			}
+		}
+		if entry == nil {
+			return ExecUser{}, fmt.Errorf("unable to find user %s: no matching entries in passwd file", userPart)
+		}
+		u.UID = entry.uid
+	}
+	if entry != nil {
+		u.GID = entry.gid
+		if entry.home != "" {
+			u.Home = entry.home
+		}
+	}
+
+	if hasGroup {
+		if u.GID, err = lookupGroup(groups, groupPart); err != nil {
+			return ExecUser{}, err
+		}
+	} else if entry != nil {
+		for _, g := range groups {
+			for _, m := range g.members {
+				if m == entry.name && g.gid != u.GID {
+					u.Groups = append(u.Groups, g.gid)
+				}
+			}
+		}
+	}
+	for _, g := range groupAdd {
+		gid, err := lookupGroup(groups, g)
+		if err != nil {
+			return ExecUser{}, err
+		}
+		u.Groups = append(u.Groups, gid)
+	}
+	return u, nil
+}
+
+func lookupGroup(groups []groupEntry, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		if id < 0 {
+			return 0, fmt.Errorf("invalid group %q", name)
+		}
+		return id, nil
+	}
+	for _, g := range groups {
+		if g.name == name {
+			return g.gid, nil
+		}
+	}
+	return 0, fmt.Errorf("unable to find group %s: no matching entries in group file", name)
+}
+
+// readPasswd parses name:password:uid:gid:gecos:home:shell lines. A missing
+// file is the same as an empty one, numeric users still work.
+func readPasswd(path string) ([]passwdEntry, error) {
+	var out []passwdEntry
+	err := readColonFile(path, func(f []string) {
+		if len(f) < 6 {
+			return
+		}
+		uid, err1 := strconv.Atoi(f[2])
+		gid, err2 := strconv.Atoi(f[3])
+		if err1 != nil || err2 != nil {
+			return
+		}
+		out = append(out, passwdEntry{name: f[0], uid: uid, gid: gid, home: f[5]})
+	})
+	return out, err
+}
+
+// readGroup parses name:password:gid:member,member lines
+func readGroup(path string) ([]groupEntry, error) {
+	var out []groupEntry
+	err := readColonFile(path, func(f []string) {
+		if len(f) < 3 {
+			return
+		}
+		gid, err := strconv.Atoi(f[2])
+		if err != nil {
+			return
+		}
+		g := groupEntry{name: f[0], gid: gid}
+		if len(f) > 3 && f[3] != "" {
+			g.members = strings.Split(f[3], ",")
+		}
+		out = append(out, g)
+	})
+	return out, err
+}
+
+func readColonFile(path string, fn func([]string)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, ":"))
+	}
+	return sc.Err()
+}
+
+// switchUser sets groups, gid and uid in that order, as each step needs the
+// privileges the next one drops. Permitted capabilities survive the uid
+// change so applyCaps can hand them to the new user.
+func switchUser(u ExecUser) error {
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("set keepcaps: %w", err)
+	}
+	// a user namespace with a single mapped id denies setgroups
+	if data, _ := os.ReadFile("/proc/self/setgroups"); strings.TrimSpace(string(data)) != "deny" {
+		if err := syscall.Setgroups(u.Groups); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+	} else if len(u.Groups) > 0 {
+		return fmt.Errorf("supplementary groups need setgroups, which this user namespace denies")
+	}
+	if err := syscall.Setgid(u.GID); err != nil {
+		return fmt.Errorf("setgid %d: %w", u.GID, err)
+	}
+	if err := syscall.Setuid(u.UID); err != nil {
+		return fmt.Errorf("setuid %d: %w", u.UID, err)
+	}
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 0, 0, 0, 0); err != nil {
+		return fmt.Errorf("clear keepcaps: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,474 @@
+package seccomp
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"myruntime/pkg/internal/kernel"
+
+	"golang.org/x/sys/unix"
+)
+
+// Program is a compiled filter ready for Install
+type Program struct {
+	Filter []unix.SockFilter
+	// Flags are SECCOMP_FILTER_FLAG_* bits from the profile
+	Flags uint
+	// Notify is set when some rule uses SCMP_ACT_NOTIFY and needs a listener
+	Notify bool
+}
+
+type archInfo struct {
+	audit uint32
+	// names Docker profiles use in includes/excludes arches
+	aliases []string
+	is64    bool
+}
+
+var arches = map[string]archInfo{
+	"SCMP_ARCH_X86_64":  {unix.AUDIT_ARCH_X86_64, []string{"amd64", "x86_64"}, true},
+	"SCMP_ARCH_X86":     {unix.AUDIT_ARCH_I386, []string{"x86", "386", "i386"}, false},
+	"SCMP_ARCH_AARCH64": {unix.AUDIT_ARCH_AARCH64, []string{"arm64", "aarch64"}, true},
+	"SCMP_ARCH_ARM":     {unix.AUDIT_ARCH_ARM, []string{"arm"}, false},
+}
+
+var nativeArches = map[string]string{
+	"amd64": "SCMP_ARCH_X86_64",
+	"386":   "SCMP_ARCH_X86",
+	"arm64": "SCMP_ARCH_AARCH64",
+	"arm":   "SCMP_ARCH_ARM",
+}
+
+var filterFlags = map[string]uint{
+	"SECCOMP_FILTER_FLAG_TSYNC":      unix.SECCOMP_FILTER_FLAG_TSYNC,
+	"SECCOMP_FILTER_FLAG_LOG":        unix.SECCOMP_FILTER_FLAG_LOG,
+	"SECCOMP_FILTER_FLAG_SPEC_ALLOW": unix.SECCOMP_FILTER_FLAG_SPEC_ALLOW,
+}
+
+var validOps = map[Operator]bool{
+	OpNotEqual: true, OpLessThan: true, OpLessEqual: true, OpEqualTo: true,
+	OpGreaterEqual: true, OpGreaterThan: true, OpMaskedEqual: true,
+}
+
+// x32 syscalls come in as x86_64 with this bit set in the number
+const x32SyscallBit = 0x40000000
+
+// offsets into struct seccomp_data
+const (
+	offNr   = 0
+	offArch = 4
+	offArgs = 16
+)
+
+// Compile turns p into a BPF program covering the native architecture and
+// the sub-architectures the profile allows. caps are the capabilities the
+// container process keeps, rules can be included or excluded on them.
+// Syscall names unknown on an architecture are skipped, as libseccomp does.
+// SCMP_ACT_NOTIFY needs a listenerPath.
+func Compile(p *Profile, caps []string) (*Program, error) {
+	native, ok := nativeArches[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("seccomp: unsupported architecture %s", runtime.GOARCH)
+	}
+	targets := []string{native}
+	for _, a := range p.Architectures {
+		if a != native {
+			targets = append(targets, a)
+		}
+	}
+	for _, m := range p.ArchMap {
+		if m.Arch == native {
+			targets = append(targets, m.SubArches...)
+		}
+	}
+	var sections []string
+	seen := map[string]bool{}
+	for _, t := range targets {
+		// archMap lists arches we have no tables for (x32, mips...), those are denied
+		if _, ok := arches[t]; ok && !seen[t] {
+			sections = append(sections, t)
+			seen[t] = true
+		}
+	}
+
+	prog := &Program{}
+	for _, f := range p.Flags {
+		v, ok := filterFlags[f]
+		if !ok {
+			return nil, fmt.Errorf("seccomp: unknown flag %s", f)
+		}
+		prog.Flags |= v
+	}
+
+	defRet, err := actionValue(p.DefaultAction, p.DefaultErrnoRet, uint(unix.EPERM))
+	if err != nil {
+		return nil, err
+	}
+	prog.Notify = p.DefaultAction == ActNotify
+	badArch := uint32(unix.SECCOMP_RET_KILL_PROCESS)
+
+	a := &assembler{}
+	a.load(offArch)
+	secLabels := make([]int, len(sections))
+	for i, s := range sections {
+		secLabels[i] = a.newLabel()
+		a.jump(unix.BPF_JEQ, arches[s].audit, next, skipOne)
+		a.ja(secLabels[i])
+	}
+	a.ret(badArch)
+
+	for i, s := range sections {
+		a.mark(secLabels[i])
+		a.load(offNr)
+		if s == "SCMP_ARCH_X86_64" {
+			a.jump(unix.BPF_JGE, x32SyscallBit, next, skipOne)
+			a.ret(badArch)
+		}
+		rules, err := archRules(p, s, caps)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rules {
+			if r.action == ActNotify {
+				prog.Notify = true
+			}
+		}
+		a.rules(rules, arches[s].is64)
+		a.ret(defRet)
+	}
+
+	// the listener fd has nowhere to go, the container would only find out
+	// once the filter is loaded
+	if prog.Notify && p.ListenerPath == "" {
+		return nil, errors.New("seccomp: profile uses SCMP_ACT_NOTIFY but has no listenerPath")
+	}
+
+	prog.Filter, err = a.assemble()
+	if err != nil {
+		return nil, err
+	}
+	return prog, nil
+}
+
+type rule struct {
+	nr     uint32
+	action Action
+	ret    uint32
+	args   []Arg
+}
+
+// archRules resolves the rules of p that apply to arch, in profile order
+func archRules(p *Profile, arch string, caps []string) ([]rule, error) {
+	table := syscallTables[arch]
+	var out []rule
+	for _, sc := range p.Syscalls {
+		if !appliesTo(sc, arch, caps) {
+			continue
+		}
+		ret, err := actionValue(sc.Action, sc.ErrnoRet, uint(unix.EPERM))
+		if err != nil {
+			return nil, err
+		}
+		names := sc.Names
+		if sc.Name != "" {
+			names = append([]string{sc.Name}, names...)
+		}
+		for _, name := range names {
+			nr, ok := table[name]
+			if !ok {
+				continue
+			}
+			for _, arg := range sc.Args {
+				if arg.Index > 5 {
+					return nil, fmt.Errorf("seccomp: %s: argument index %d out of range", name, arg.Index)
+				}
+				if !validOps[arg.Op] {
+					return nil, fmt.Errorf("seccomp: %s: unknown operator %q", name, arg.Op)
+				}
+			}
+			out = append(out, rule{nr: uint32(nr), action: sc.Action, ret: ret, args: sc.Args})
+		}
+	}
+	return out, nil
+}
+
+func appliesTo(sc Syscall, arch string, caps []string) bool {
+	aliases := arches[arch].aliases
+	inArch := func(list []string) bool {
+		for _, l := range list {
+			if l == arch {
+				return true
+			}
+			for _, a := range aliases {
+				if l == a {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	hasCap := func(c string) bool {
+		c = strings.ToUpper(c)
+		for _, have := range caps {
+			if strings.ToUpper(have) == c {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(sc.Includes.Arches) > 0 && !inArch(sc.Includes.Arches) {
+		return false
+	}
+	if len(sc.Excludes.Arches) > 0 && inArch(sc.Excludes.Arches) {
+		return false
+	}
+	for _, c := range sc.Includes.Caps {
+		if !hasCap(c) {
+			return false
+		}
+	}
+	for _, c := range sc.Excludes.Caps {
+		if hasCap(c) {
+			return false
+		}
+	}
+	if sc.Includes.MinKernel != "" && !kernel.AtLeast(sc.Includes.MinKernel) {
+		return false
+	}
+	if sc.Excludes.MinKernel != "" && kernel.AtLeast(sc.Excludes.MinKernel) {
+		return false
+	}
+	return true
+}
+
+func actionValue(act Action, errnoRet *uint, defErrno uint) (uint32, error) {
+	data := uint32(defErrno)
+	if errnoRet != nil {
+		data = uint32(*errnoRet)
+	}
+	data &= unix.SECCOMP_RET_DATA
+	switch act {
+	case ActKill, ActKillThread:
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case ActKillProcess:
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case ActTrap:
+		return unix.SECCOMP_RET_TRAP, nil
+	case ActErrno:
+		return unix.SECCOMP_RET_ERRNO | data, nil
+	case ActTrace:
+		return unix.SECCOMP_RET_TRACE | data, nil
+	case ActAllow:
+		return unix.SECCOMP_RET_ALLOW, nil
+	case ActLog:
+		return unix.SECCOMP_RET_LOG, nil
+	case ActNotify:
+		return unix.SECCOMP_RET_USER_NOTIF, nil
+	}
+	return 0, fmt.Errorf("seccomp: unknown action %q", act)
+}
+
+// jump targets with a fixed meaning, real labels are >= 0
+const (
+	next    = -1 // the following instruction
+	skipOne = -2 // the one after it
+)
+
+type insn struct {
+	f  unix.SockFilter
+	jt int
+	jf int
+	// ja is the label of an unconditional jump
+	ja int
+}
+
+// assembler builds classic BPF with forward labels. Conditional jumps only
+// reach 255 instructions, so they stay within one rule; sections are
+// reached through ja, which has a 32 bit offset.
+type assembler struct {
+	insns  []insn
+	labels []int
+}
+
+func (a *assembler) newLabel() int {
+	a.labels = append(a.labels, -1)
+	return len(a.labels) - 1
+}
+
+func (a *assembler) mark(l int) {
+	a.labels[l] = len(a.insns)
+}
+
+func (a *assembler) emit(code uint16, k uint32, jt, jf int) {
+	a.insns = append(a.insns, insn{f: unix.SockFilter{Code: code, K: k}, jt: jt, jf: jf, ja: -1})
+}
+
+func (a *assembler) load(off uint32) {
+	a.emit(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, off, next, next)
+}
+
+func (a *assembler) and(k uint32) {
+	a.emit(unix.BPF_ALU|unix.BPF_AND|unix.BPF_K, k, next, next)
+}
+
+func (a *assembler) jump(op uint16, k uint32, jt, jf int) {
+	a.emit(unix.BPF_JMP|op|unix.BPF_K, k, jt, jf)
+}
+
+func (a *assembler) ja(l int) {
+	a.insns = append(a.insns, insn{f: unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JA}, jt: next, jf: next, ja: l})
+}
+
+func (a *assembler) ret(k uint32) {
+	a.emit(unix.BPF_RET|unix.BPF_K, k, next, next)
+}
+
+// rules emits the syscall checks of one architecture section. The
+// accumulator holds the syscall number on entry.
+func (a *assembler) rules(rules []rule, is64 bool) {
+	nrLoaded := true
+	for i := 0; i < len(rules); {
+		if len(rules[i].args) > 0 {
+			a.argRule(rules[i], is64, nrLoaded)
+			nrLoaded = false
+			i++
+			continue
+		}
+		// plain rules sharing an action jump to a single ret
+		j := i
+		for j < len(rules) && j-i < 250 && len(rules[j].args) == 0 && rules[j].ret == rules[i].ret {
+			j++
+		}
+		if !nrLoaded {
+			a.load(offNr)
+			nrLoaded = true
+		}
+		retL, after := a.newLabel(), a.newLabel()
+		for _, r := range rules[i:j] {
+			a.jump(unix.BPF_JEQ, r.nr, retL, next)
+		}
+		a.ja(after)
+		a.mark(retL)
+		a.ret(rules[i].ret)
+		a.mark(after)
+		i = j
+	}
+}
+
+func (a *assembler) argRule(r rule, is64, nrLoaded bool) {
+	end := a.newLabel()
+	if !nrLoaded {
+		a.load(offNr)
+	}
+	a.jump(unix.BPF_JEQ, r.nr, next, end)
+	for _, arg := range r.args {
+		pass := a.newLabel()
+		a.argCheck(arg, is64, pass, end)
+		a.mark(pass)
+	}
+	a.ret(r.ret)
+	a.mark(end)
+}
+
+// argCheck compares one argument, jumping to pass or fail. On 64 bit
+// arches the high word decides unless it is equal, then the low word does.
+func (a *assembler) argCheck(arg Arg, is64 bool, pass, fail int) {
+	lo := offArgs + 8*uint32(arg.Index)
+	hi := lo + 4
+	v, v2 := arg.Value, arg.ValueTwo
+	vl, vh := uint32(v), uint32(v>>32)
+
+	switch arg.Op {
+	case OpEqualTo:
+		if is64 {
+			a.load(hi)
+			a.jump(unix.BPF_JEQ, vh, next, fail)
+		}
+		a.load(lo)
+		a.jump(unix.BPF_JEQ, vl, pass, fail)
+	case OpNotEqual:
+		if is64 {
+			a.load(hi)
+			a.jump(unix.BPF_JEQ, vh, next, pass)
+		}
+		a.load(lo)
+		a.jump(unix.BPF_JEQ, vl, fail, pass)
+	case OpMaskedEqual:
+		if is64 {
+			a.load(hi)
+			a.and(vh)
+			a.jump(unix.BPF_JEQ, uint32(v2>>32), next, fail)
+		}
+		a.load(lo)
+		a.and(vl)
+		a.jump(unix.BPF_JEQ, uint32(v2), pass, fail)
+	case OpGreaterThan, OpGreaterEqual:
+		if is64 {
+			a.load(hi)
+			a.jump(unix.BPF_JGT, vh, pass, next)
+			a.jump(unix.BPF_JEQ, vh, next, fail)
+		}
+		a.load(lo)
+		op := uint16(unix.BPF_JGT)
+		if arg.Op == OpGreaterEqual {
+			op = unix.BPF_JGE
+		}
+		a.jump(op, vl, pass, fail)
+	case OpLessThan, OpLessEqual:
+		if is64 {
+			a.load(hi)
+			a.jump(unix.BPF_JGT, vh, fail, next)
+			a.jump(unix.BPF_JEQ, vh, next, pass)
+		}
+		a.load(lo)
+		op := uint16(unix.BPF_JGE)
+		if arg.Op == OpLessEqual {
+			op = unix.BPF_JGT
+		}
+		a.jump(op, vl, fail, pass)
+	}
+}
+
+func (a *assembler) assemble() ([]unix.SockFilter, error) {
+	if len(a.insns) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("seccomp: filter has %d instructions, limit is %d", len(a.insns), unix.BPF_MAXINSNS)
+	}
+	out := make([]unix.SockFilter, len(a.insns))
+	for i, in := range a.insns {
+		f := in.f
+		if in.ja >= 0 {
+			f.K = uint32(a.labels[in.ja] - i - 1)
+		} else if f.Code&0x07 == unix.BPF_JMP {
+			jt, err := a.offset(i, in.jt)
+			if err != nil {
+				return nil, err
+			}
+			jf, err := a.offset(i, in.jf)
+			if err != nil {
+				return nil, err
+			}
+			f.Jt, f.Jf = jt, jf
+		}
+		out[i] = f
+	}
+	return out, nil
+}
+
+func (a *assembler) offset(i, target int) (uint8, error) {
+	var off int
+	switch target {
+	case next:
+		off = 0
+	case skipOne:
+		off = 1
+	default:
+		off = a.labels[target] - i - 1
+	}
+	if off < 0 || off > 255 {
+		return 0, errors.New("seccomp: jump out of range")
+	}
+	return uint8(off), nil
+}
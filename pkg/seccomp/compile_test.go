@@ -0,0 +1,386 @@
+package seccomp
+
+import (
+	"math"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// seccompData is the struct seccomp_data a filter sees
+type seccompData struct {
+	nr   uint32
+	arch uint32
+	args [6]uint64
+}
+
+// word loads the 32 bit word at off like BPF_LD|BPF_W|BPF_ABS does on a
+// little-endian machine, low word of an argument first
+func (d seccompData) word(t *testing.T, off uint32) uint32 {
+	switch {
+	case off == offNr:
+		return d.nr
+	case off == offArch:
+		return d.arch
+	case off >= offArgs && off < offArgs+6*8 && off%4 == 0:
+		arg := d.args[(off-offArgs)/8]
+		if (off-offArgs)%8 == 4 {
+			return uint32(arg >> 32)
+		}
+		return uint32(arg)
+	}
+	t.Fatalf("load of offset %d", off)
+	return 0
+}
+
+// runFilter interprets the classic BPF the compiler emits
+func runFilter(t *testing.T, prog []unix.SockFilter, d seccompData) uint32 {
+	t.Helper()
+	var acc uint32
+	for pc := 0; pc < len(prog); pc++ {
+		f := prog[pc]
+		var cond bool
+		switch f.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			acc = d.word(t, f.K)
+			continue
+		case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
+			acc &= f.K
+			continue
+		case unix.BPF_JMP | unix.BPF_JA:
+			pc += int(f.K)
+			continue
+		case unix.BPF_RET | unix.BPF_K:
+			return f.K
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+			cond = acc == f.K
+		case unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K:
+			cond = acc > f.K
+		case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			cond = acc >= f.K
+		default:
+			t.Fatalf("instruction %d: unknown code %#x", pc, f.Code)
+		}
+		if cond {
+			pc += int(f.Jt)
+		} else {
+			pc += int(f.Jf)
+		}
+	}
+	t.Fatalf("filter ran past its end")
+	return 0
+}
+
+func nativeArch(t *testing.T) string {
+	native, ok := nativeArches[runtime.GOARCH]
+	if !ok {
+		t.Skipf("no seccomp tables for %s", runtime.GOARCH)
+	}
+	return native
+}
+
+// call builds the seccomp_data of syscall name on arch
+func call(t *testing.T, arch, name string, args ...uint64) seccompData {
+	t.Helper()
+	nr, ok := syscallTables[arch][name]
+	if !ok {
+		t.Fatalf("no syscall %s on %s", name, arch)
+	}
+	d := seccompData{nr: uint32(nr), arch: arches[arch].audit}
+	copy(d.args[:], args)
+	return d
+}
+
+func compile(t *testing.T, p *Profile, caps []string) []unix.SockFilter {
+	t.Helper()
+	prog, err := Compile(p, caps)
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	if len(prog.Filter) > unix.BPF_MAXINSNS {
+		t.Fatalf("filter has %d instructions", len(prog.Filter))
+	}
+	return prog.Filter
+}
+
+func errnoRet(n uint) *uint {
+	return &n
+}
+
+const (
+	retAllow = unix.SECCOMP_RET_ALLOW
+	retKill  = unix.SECCOMP_RET_KILL_PROCESS
+	retEPERM = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+)
+
+func TestAllowAndErrno(t *testing.T) {
+	arch := nativeArch(t)
+	prog := compile(t, &Profile{
+		DefaultAction: ActErrno,
+		Syscalls: []Syscall{
+			{Names: []string{"getpid", "read"}, Action: ActAllow},
+			{Name: "mkdir", Action: ActErrno, ErrnoRet: errnoRet(uint(unix.ENOSYS))},
+			{Names: []string{"no_such_syscall"}, Action: ActAllow},
+		},
+	}, nil)
+	for _, tc := range []struct {
+		name string
+		want uint32
+	}{
+		{"getpid", retAllow},
+		{"read", retAllow},
+		{"mkdir", unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS)},
+		{"personality", retEPERM},
+	} {
+		if got := runFilter(t, prog, call(t, arch, tc.name)); got != tc.want {
+			t.Errorf("%s: got %#x, want %#x", tc.name, got, tc.want)
+		}
+	}
+}
+
+// compare is what an argument condition means on the full 64 bit value
+func compare(op Operator, arg, v, v2 uint64) bool {
+	switch op {
+	case OpEqualTo:
+		return arg == v
+	case OpNotEqual:
+		return arg != v
+	case OpLessThan:
+		return arg < v
+	case OpLessEqual:
+		return arg <= v
+	case OpGreaterThan:
+		return arg > v
+	case OpGreaterEqual:
+		return arg >= v
+	case OpMaskedEqual:
+		return arg&v == v2
+	}
+	panic(op)
+}
+
+var operators = []Operator{OpEqualTo, OpNotEqual, OpLessThan, OpLessEqual, OpGreaterThan, OpGreaterEqual, OpMaskedEqual}
+
+// operands differ from the compared value in the low word, the high word or
+// both, in either direction
+var operands = []uint64{
+	0,
+	4,
+	5,
+	6,
+	math.MaxUint32,
+	1 << 32,
+	1<<32 | 4,
+	1<<32 | 5,
+	1<<32 | 6,
+	2 << 32,
+	2<<32 | 5,
+	math.MaxUint64,
+}
+
+func TestArgOperators(t *testing.T) {
+	arch := nativeArch(t)
+	if !arches[arch].is64 {
+		t.Skip("native architecture is 32 bit")
+	}
+	for _, op := range operators {
+		for _, value := range []uint64{5, 1<<32 | 5} {
+			v2 := value & 0xff0000000f
+			prog := compile(t, &Profile{
+				DefaultAction: ActErrno,
+				Syscalls: []Syscall{{
+					Names:  []string{"personality"},
+					Action: ActAllow,
+					Args:   []Arg{{Index: 1, Value: value, ValueTwo: v2, Op: op}},
+				}},
+			}, nil)
+			for _, arg := range operands {
+				want := retEPERM
+				if compare(op, arg, value, v2) {
+					want = retAllow
+				}
+				if got := runFilter(t, prog, call(t, arch, "personality", 0, arg)); got != want {
+					t.Errorf("%s %#x against %#x: got %#x, want %#x", op, arg, value, got, want)
+				}
+			}
+		}
+	}
+}
+
+// compatArches are 32 bit arches a native one runs binaries of
+var compatArches = map[string]string{
+	"SCMP_ARCH_X86_64":  "SCMP_ARCH_X86",
+	"SCMP_ARCH_AARCH64": "SCMP_ARCH_ARM",
+}
+
+func TestArgOperators32(t *testing.T) {
+	arch, ok := compatArches[nativeArch(t)]
+	if !ok {
+		t.Skip("no 32 bit sub-architecture")
+	}
+	// only the low word of an argument exists on a 32 bit arch
+	for _, op := range operators {
+		prog := compile(t, &Profile{
+			DefaultAction: ActErrno,
+			Architectures: []string{arch},
+			Syscalls: []Syscall{{
+				Names:  []string{"personality"},
+				Action: ActAllow,
+				Args:   []Arg{{Index: 0, Value: 5, ValueTwo: 4, Op: op}},
+			}},
+		}, nil)
+		for _, arg := range operands {
+			want := retEPERM
+			if compare(op, uint64(uint32(arg)), 5, 4) {
+				want = retAllow
+			}
+			if got := runFilter(t, prog, call(t, arch, "personality", arg)); got != want {
+				t.Errorf("%s %#x: got %#x, want %#x", op, arg, got, want)
+			}
+		}
+	}
+}
+
+func TestMultipleConditions(t *testing.T) {
+	arch := nativeArch(t)
+	prog := compile(t, &Profile{
+		DefaultAction: ActErrno,
+		Syscalls: []Syscall{{
+			Names:  []string{"personality"},
+			Action: ActAllow,
+			Args: []Arg{
+				{Index: 0, Value: 1, Op: OpGreaterEqual},
+				{Index: 2, Value: 10, Op: OpLessThan},
+			},
+		}},
+	}, nil)
+	for _, tc := range []struct {
+		a0, a2 uint64
+		want   uint32
+	}{
+		{1, 9, retAllow},
+		{0, 9, retEPERM},
+		{1, 10, retEPERM},
+		{0, 10, retEPERM},
+	} {
+		if got := runFilter(t, prog, call(t, arch, "personality", tc.a0, 0, tc.a2)); got != tc.want {
+			t.Errorf("args %d, %d: got %#x, want %#x", tc.a0, tc.a2, got, tc.want)
+		}
+	}
+}
+
+// TestLongRuleList makes rule groups and jumps over many rules, past what a
+// conditional jump reaches
+func TestLongRuleList(t *testing.T) {
+	arch := nativeArch(t)
+	var names []string
+	for name := range syscallTables[arch] {
+		if name != "personality" {
+			names = append(names, name)
+		}
+	}
+	prog := compile(t, &Profile{
+		DefaultAction: ActErrno,
+		Syscalls: []Syscall{
+			{Names: names, Action: ActAllow},
+			{Names: []string{"personality"}, Action: ActAllow, Args: []Arg{{Index: 0, Value: 8, Op: OpEqualTo}}},
+		},
+	}, nil)
+	for _, name := range names {
+		if got := runFilter(t, prog, call(t, arch, name)); got != retAllow {
+			t.Fatalf("%s: got %#x, want allow", name, got)
+		}
+	}
+	if got := runFilter(t, prog, call(t, arch, "personality", 8)); got != retAllow {
+		t.Errorf("personality(8): got %#x, want allow", got)
+	}
+	if got := runFilter(t, prog, call(t, arch, "personality", 9)); got != retEPERM {
+		t.Errorf("personality(9): got %#x, want EPERM", got)
+	}
+}
+
+func TestArchitectures(t *testing.T) {
+	arch := nativeArch(t)
+	p := &Profile{
+		DefaultAction: ActAllow,
+		Syscalls:      []Syscall{{Names: []string{"getpid"}, Action: ActErrno}},
+	}
+	prog := compile(t, p, nil)
+	if got := runFilter(t, prog, call(t, arch, "getpid")); got != retEPERM {
+		t.Errorf("native getpid: got %#x, want EPERM", got)
+	}
+	unknown := seccompData{nr: 1, arch: unix.AUDIT_ARCH_MIPS}
+	if got := runFilter(t, prog, unknown); got != retKill {
+		t.Errorf("unknown arch: got %#x, want kill", got)
+	}
+	compat, ok := compatArches[arch]
+	if !ok {
+		return
+	}
+	// a sub-architecture the profile doesn't allow is killed, one it allows
+	// gets its own syscall numbers checked
+	if got := runFilter(t, prog, call(t, compat, "getpid")); got != retKill {
+		t.Errorf("%s without archMap: got %#x, want kill", compat, got)
+	}
+	p.ArchMap = []ArchMap{{Arch: arch, SubArches: []string{compat, "SCMP_ARCH_X32"}}}
+	prog = compile(t, p, nil)
+	if got := runFilter(t, prog, call(t, compat, "getpid")); got != retEPERM {
+		t.Errorf("%s getpid: got %#x, want EPERM", compat, got)
+	}
+	if got := runFilter(t, prog, call(t, compat, "read")); got != retAllow {
+		t.Errorf("%s read: got %#x, want allow", compat, got)
+	}
+
+	if arch != "SCMP_ARCH_X86_64" {
+		return
+	}
+	// x32 has no tables, its calls come in as x86_64 with the x32 bit set
+	x32 := call(t, arch, "read")
+	x32.nr |= x32SyscallBit
+	if got := runFilter(t, prog, x32); got != retKill {
+		t.Errorf("x32 read: got %#x, want kill", got)
+	}
+}
+
+func TestDefaultProfile(t *testing.T) {
+	arch := nativeArch(t)
+	prog := compile(t, DefaultProfile(), []string{"CAP_CHOWN", "CAP_SYS_CHROOT"})
+	for _, tc := range []struct {
+		name string
+		args []uint64
+		want uint32
+	}{
+		{"getpid", nil, retAllow},
+		{"read", nil, retAllow},
+		{"chroot", nil, retAllow},
+		{"reboot", nil, retEPERM},
+		{"kexec_load", nil, retEPERM},
+		{"personality", []uint64{0}, retAllow},
+		{"personality", []uint64{8}, retAllow},
+		{"personality", []uint64{4}, retEPERM},
+	} {
+		if got := runFilter(t, prog, call(t, arch, tc.name, tc.args...)); got != tc.want {
+			t.Errorf("%s%v: got %#x, want %#x", tc.name, tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestNotifyNeedsListener(t *testing.T) {
+	nativeArch(t)
+	p := &Profile{
+		DefaultAction: ActAllow,
+		Syscalls:      []Syscall{{Names: []string{"mkdir"}, Action: ActNotify}},
+	}
+	if _, err := Compile(p, nil); err == nil {
+		t.Errorf("notify without listenerPath compiled")
+	}
+	p.ListenerPath = "/run/agent.sock"
+	prog, err := Compile(p, nil)
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	if !prog.Notify {
+		t.Errorf("Notify not set")
+	}
+}
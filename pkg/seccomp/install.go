@@ -0,0 +1,80 @@
+package seccomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Install loads prog into the calling process. Without a notify listener
+// the filter is synced to every thread. It returns the listener fd when
+// prog uses SCMP_ACT_NOTIFY and -1 otherwise.
+func Install(prog *Program) (int, error) {
+	fprog := unix.SockFprog{
+		Len:    uint16(len(prog.Filter)),
+		Filter: &prog.Filter[0],
+	}
+	flags := prog.Flags
+	if prog.Notify {
+		// TSYNC and NEW_LISTENER only mix on 5.7+; the caller runs on a locked thread
+		flags &^= unix.SECCOMP_FILTER_FLAG_TSYNC
+		flags |= unix.SECCOMP_FILTER_FLAG_NEW_LISTENER
+	} else {
+		flags |= unix.SECCOMP_FILTER_FLAG_TSYNC
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, uintptr(flags), uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return -1, fmt.Errorf("seccomp: loading filter: %w", errno)
+	}
+	if !prog.Notify {
+		return -1, nil
+	}
+	return int(fd), nil
+}
+
+// DialListener connects to the seccomp agent socket named by a profile's
+// listenerPath. It has to happen before the container pivots away from the host fs.
+func DialListener(path string) (*net.UnixConn, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("seccomp: connecting to listener %s: %w", path, err)
+	}
+	return conn, nil
+}
+
+// processState is the OCI runtime-spec message sent with the listener fd
+type processState struct {
+	Version  string   `json:"ociVersion"`
+	Fds      []string `json:"fds"`
+	Pid      int      `json:"pid"`
+	Metadata string   `json:"metadata,omitempty"`
+	State    struct {
+		Version string `json:"ociVersion"`
+		ID      string `json:"id"`
+		Status  string `json:"status"`
+		Pid     int    `json:"pid"`
+		Bundle  string `json:"bundle"`
+	} `json:"state"`
+}
+
+// SendListener hands the notify fd to the seccomp agent, OCI style
+func SendListener(conn *net.UnixConn, fd int, id, metadata string) error {
+	defer conn.Close()
+	st := processState{Version: "1.0.2", Fds: []string{"seccompFd"}, Pid: os.Getpid(), Metadata: metadata}
+	st.State.Version = st.Version
+	st.State.ID = id
+	st.State.Status = "creating"
+	st.State.Pid = os.Getpid()
+	msg, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if _, _, err := conn.WriteMsgUnix(msg, unix.UnixRights(fd), nil); err != nil {
+		return fmt.Errorf("seccomp: sending listener fd: %w", err)
+	}
+	return unix.Close(fd)
+}
@@ -0,0 +1,84 @@
+//go:build ignore
+
+// mksyscalls generates zsyscalls.go, the syscall name tables of every
+// architecture the compiler can emit filters for, from the x/sys/unix sources.
+//
+//	go run mksyscalls.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// libseccomp architecture name -> x/sys/unix GOARCH
+var arches = []struct{ scmp, goarch string }{
+	{"SCMP_ARCH_X86_64", "amd64"},
+	{"SCMP_ARCH_X86", "386"},
+	{"SCMP_ARCH_AARCH64", "arm64"},
+	{"SCMP_ARCH_ARM", "arm"},
+}
+
+var sysRe = regexp.MustCompile(`^\s*SYS_(\w+)\s*=\s*(\d+)`)
+
+func main() {
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "golang.org/x/sys").Output()
+	if err != nil {
+		log.Fatalf("locating golang.org/x/sys: %v", err)
+	}
+	dir := filepath.Join(strings.TrimSpace(string(out)), "unix")
+
+	var b bytes.Buffer
+	b.WriteString("// Code generated by mksyscalls.go; DO NOT EDIT.\n\npackage seccomp\n\n")
+	b.WriteString("var syscallTables = map[string]map[string]int{\n")
+	for _, a := range arches {
+		table, err := readTable(filepath.Join(dir, "zsysnum_linux_"+a.goarch+".go"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		names := make([]string, 0, len(table))
+		for n := range table {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&b, "%q: {\n", a.scmp)
+		for _, n := range names {
+			fmt.Fprintf(&b, "%q: %s,\n", n, table[n])
+		}
+		b.WriteString("},\n")
+	}
+	b.WriteString("}\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("zsyscalls.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func readTable(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	table := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if m := sysRe.FindStringSubmatch(sc.Text()); m != nil {
+			table[strings.ToLower(m[1])] = m[2]
+		}
+	}
+	return table, sc.Err()
+}
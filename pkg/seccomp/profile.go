@@ -0,0 +1,108 @@
+package seccomp
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Action is a libseccomp action name, e.g. SCMP_ACT_ERRNO
+type Action string
+
+const (
+	ActKill        Action = "SCMP_ACT_KILL"
+	ActKillProcess Action = "SCMP_ACT_KILL_PROCESS"
+	ActKillThread  Action = "SCMP_ACT_KILL_THREAD"
+	ActTrap        Action = "SCMP_ACT_TRAP"
+	ActErrno       Action = "SCMP_ACT_ERRNO"
+	ActTrace       Action = "SCMP_ACT_TRACE"
+	ActAllow       Action = "SCMP_ACT_ALLOW"
+	ActLog         Action = "SCMP_ACT_LOG"
+	ActNotify      Action = "SCMP_ACT_NOTIFY"
+)
+
+// Operator compares a syscall argument
+type Operator string
+
+const (
+	OpNotEqual     Operator = "SCMP_CMP_NE"
+	OpLessThan     Operator = "SCMP_CMP_LT"
+	OpLessEqual    Operator = "SCMP_CMP_LE"
+	OpEqualTo      Operator = "SCMP_CMP_EQ"
+	OpGreaterEqual Operator = "SCMP_CMP_GE"
+	OpGreaterThan  Operator = "SCMP_CMP_GT"
+	OpMaskedEqual  Operator = "SCMP_CMP_MASKED_EQ"
+)
+
+// Profile is a seccomp profile in the Docker/OCI JSON format
+type Profile struct {
+	DefaultAction    Action    `json:"defaultAction"`
+	DefaultErrnoRet  *uint     `json:"defaultErrnoRet,omitempty"`
+	Architectures    []string  `json:"architectures,omitempty"`
+	ArchMap          []ArchMap `json:"archMap,omitempty"`
+	ListenerPath     string    `json:"listenerPath,omitempty"`
+	ListenerMetadata string    `json:"listenerMetadata,omitempty"`
+	Flags            []string  `json:"flags,omitempty"`
+	Syscalls         []Syscall `json:"syscalls"`
+}
+
+// ArchMap lists the sub-architectures allowed next to a native one
+type ArchMap struct {
+	Arch      string   `json:"architecture"`
+	SubArches []string `json:"subArchitectures"`
+}
+
+// Syscall is one rule: the action to take for names when all args match
+type Syscall struct {
+	Name     string   `json:"name,omitempty"`
+	Names    []string `json:"names,omitempty"`
+	Action   Action   `json:"action"`
+	ErrnoRet *uint    `json:"errnoRet,omitempty"`
+	Args     []Arg    `json:"args,omitempty"`
+	Includes Filter   `json:"includes,omitempty"`
+	Excludes Filter   `json:"excludes,omitempty"`
+}
+
+// Filter restricts a rule to some architectures, capabilities or kernels
+type Filter struct {
+	Arches    []string `json:"arches,omitempty"`
+	Caps      []string `json:"caps,omitempty"`
+	MinKernel string   `json:"minKernel,omitempty"`
+}
+
+// Arg is a condition on the syscall argument at Index
+type Arg struct {
+	Index    uint     `json:"index"`
+	Value    uint64   `json:"value"`
+	ValueTwo uint64   `json:"valueTwo"`
+	Op       Operator `json:"op"`
+}
+
+//go:embed default.json
+var defaultProfile []byte
+
+// DefaultProfile returns the built-in profile, modeled on Docker's default
+func DefaultProfile() *Profile {
+	var p Profile
+	if err := json.Unmarshal(defaultProfile, &p); err != nil {
+		panic(fmt.Sprintf("seccomp: bad built-in profile: %v", err))
+	}
+	return &p
+}
+
+// LoadProfile reads a Docker/OCI seccomp JSON profile
+func LoadProfile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parsing seccomp profile %s: %w", path, err)
+	}
+	if p.DefaultAction == "" {
+		return nil, fmt.Errorf("seccomp profile %s has no defaultAction", path)
+	}
+	return &p, nil
+}
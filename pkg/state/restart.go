@@ -0,0 +1,67 @@
+package state
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Restart policies
+const (
+	RestartNo            = "no"
+	RestartOnFailure     = "on-failure"
+	RestartAlways        = "always"
+	RestartUnlessStopped = "unless-stopped"
+)
+
+// RestartPolicy says when the runtime supervising a container runs it again
+type RestartPolicy struct {
+	Name string `json:"name"`
+	// MaxRetries caps on-failure restarts, 0 restarts without limit
+	MaxRetries int `json:"maxRetries,omitempty"`
+}
+
+// ParseRestartPolicy parses no, on-failure[:max-retries], always or unless-stopped
+func ParseRestartPolicy(s string) (RestartPolicy, error) {
+	name, max, hasMax := strings.Cut(s, ":")
+	p := RestartPolicy{Name: name}
+	switch name {
+	case RestartNo, RestartAlways, RestartUnlessStopped:
+		if hasMax {
+			return p, fmt.Errorf("restart policy %s takes no maximum retry count", name)
+		}
+	case RestartOnFailure:
+		if hasMax {
+			n, err := strconv.Atoi(max)
+			if err != nil || n < 0 {
+				return p, fmt.Errorf("invalid maximum retry count %s", max)
+			}
+			p.MaxRetries = n
+		}
+	default:
+		return p, fmt.Errorf("invalid restart policy %s", s)
+	}
+	return p, nil
+}
+
+// ShouldRestart reports whether a container that exited with exitCode after
+// restarts restarts runs again. An explicit stop is never undone.
+func (p RestartPolicy) ShouldRestart(exitCode, restarts int, stopRequested bool) bool {
+	if stopRequested {
+		return false
+	}
+	switch p.Name {
+	case RestartAlways, RestartUnlessStopped:
+		return true
+	case RestartOnFailure:
+		return exitCode != 0 && (p.MaxRetries == 0 || restarts < p.MaxRetries)
+	}
+	return false
+}
+
+func (p RestartPolicy) String() string {
+	if p.Name == RestartOnFailure && p.MaxRetries > 0 {
+		return fmt.Sprintf("%s:%d", p.Name, p.MaxRetries)
+	}
+	return p.Name
+}
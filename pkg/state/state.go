@@ -0,0 +1,274 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"myruntime/pkg/fs"
+	"myruntime/pkg/health"
+	"myruntime/pkg/userns"
+)
+
+// Container statuses
+const (
+	Created = "created"
+	Running = "running"
+	// Restarting is a container waiting out its restart backoff
+	Restarting = "restarting"
+	Exited     = "exited"
+)
+
+// Container is the persistent record of one container, state.json in its dir
+type Container struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Image       string `json:"image"`
+	ImageDigest string `json:"imageDigest,omitempty"`
+	// Args is the command line the container was created with, start reuses it
+	Args []string `json:"args"`
+	// Cmd is the command run in the container
+	Cmd []string `json:"cmd"`
+	// TTY and Interactive say whether the container has a terminal and an open stdin
+	TTY         bool              `json:"tty,omitempty"`
+	Interactive bool              `json:"interactive,omitempty"`
+	Storage     string            `json:"storage"`
+	Options     fs.StorageOptions `json:"storageOptions"`
+	// QuotaBackend is what limits the size of the writable layer, if anything
+	QuotaBackend string `json:"quotaBackend,omitempty"`
+	// UIDMap and GIDMap are the id maps the layer was shifted to
+	UIDMap []userns.IDMap `json:"uidMap,omitempty"`
+	GIDMap []userns.IDMap `json:"gidMap,omitempty"`
+	// Rootfs is where the root filesystem is mounted while the container runs
+	Rootfs string `json:"rootfs"`
+	Status string `json:"status"`
+	// Paused is set while the running container's cgroup is frozen
+	Paused bool `json:"paused,omitempty"`
+	Pid    int  `json:"pid,omitempty"`
+	// ShimPid is the runtime process supervising the container
+	ShimPid    int      `json:"shimPid,omitempty"`
+	CgroupPath string   `json:"cgroupPath,omitempty"`
+	IPs        []string `json:"ips,omitempty"`
+	// StopSignal is what stop sends first, SIGTERM when empty
+	StopSignal string        `json:"stopSignal,omitempty"`
+	Restart    RestartPolicy `json:"restartPolicy"`
+	// RestartCount is how often the container was restarted since it was started
+	RestartCount int `json:"restartCount"`
+	// StopRequested is set by stop, the restart policy doesn't bring the
+	// container back after it
+	StopRequested bool `json:"stopRequested,omitempty"`
+	// Healthcheck is the image's merged with the command line's, Health
+	// the container's health while it has one
+	Healthcheck *health.Config `json:"healthcheck,omitempty"`
+	Health      *health.State  `json:"health,omitempty"`
+	// Bundle and Annotations are those of a container created from an OCI bundle
+	Bundle      string            `json:"bundle,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// LogPath is the json-file log of a detached container
+	LogPath   string    `json:"logPath,omitempty"`
+	Created   time.Time `json:"created"`
+	Started   time.Time `json:"started,omitempty"`
+	Finished  time.Time `json:"finished,omitempty"`
+	ExitCode  int       `json:"exitCode"`
+	OOMKilled bool      `json:"oomKilled,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Alive reports whether the container's init still exists. A running
+// container whose init is gone was left behind by a runtime that died.
+func (c *Container) Alive() bool {
+	if c.Status != Running || c.Pid <= 0 {
+		return false
+	}
+	return syscall.Kill(c.Pid, 0) != syscall.ESRCH
+}
+
+// DefaultRoot is /run/myruntime, or a directory of the calling user for
+// rootless runtimes and for unprivileged users outside of one
+func DefaultRoot() string {
+	if !userns.Rootless() && os.Geteuid() == 0 {
+		return "/run/myruntime"
+	}
+	if xdg := os.Getenv("XDG_RUNTIME_DIR"); xdg != "" {
+		return filepath.Join(xdg, "myruntime")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("myruntime-%d", userns.RootlessUID()), "run")
+}
+
+// ErrNotFound is returned when no container matches a name or ID
+var ErrNotFound = errors.New("no such container")
+
+// Store keeps container records under Root, one directory per ID. Every
+// change happens under an flock, so concurrent runtimes don't clobber each other.
+type Store struct {
+	Root string
+}
+
+// Dir is the directory of container id
+func (s Store) Dir(id string) string {
+	return filepath.Join(s.Root, id)
+}
+
+// Create records a new container, its name must be unused
+func (s Store) Create(c *Container) error {
+	return s.CreateWith(c, nil)
+}
+
+// CreateWith records a new container like Create, calling fn first with the
+// records of every other container under the same lock. What fn hands out
+// to c from what they hold, ids say, can't be handed out twice.
+func (s Store) CreateWith(c *Container, fn func(c *Container, others []*Container) error) error {
+	if err := os.MkdirAll(s.Root, 0700); err != nil {
+		return err
+	}
+	unlock, err := lock(filepath.Join(s.Root, ".lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	all, err := s.List()
+	if err != nil {
+		return err
+	}
+	for _, o := range all {
+		if o.Name == c.Name {
+			return fmt.Errorf("container name %q is already in use by %s", c.Name, o.ID[:12])
+		}
+	}
+	if fn != nil {
+		if err := fn(c, all); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(s.Dir(c.ID), 0700); err != nil {
+		return err
+	}
+	return s.write(c)
+}
+
+// Load reads the record of container id
+func (s Store) Load(id string) (*Container, error) {
+	data, err := os.ReadFile(filepath.Join(s.Dir(id), "state.json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c Container
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("reading state of %s: %w", id, err)
+	}
+	return &c, nil
+}
+
+// Update applies fn to the record of container id under its lock
+func (s Store) Update(id string, fn func(c *Container) error) error {
+	unlock, err := lock(filepath.Join(s.Dir(id), ".lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	c, err := s.Load(id)
+	if err != nil {
+		return err
+	}
+	if err := fn(c); err != nil {
+		return err
+	}
+	return s.write(c)
+}
+
+// List returns every container, newest first
+func (s Store) List() ([]*Container, error) {
+	entries, err := os.ReadDir(s.Root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []*Container
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		c, err := s.Load(e.Name())
+		if err != nil {
+			// being created or removed
+			continue
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out, nil
+}
+
+// Lookup finds a container by name, full ID or unique ID prefix
+func (s Store) Lookup(ref string) (*Container, error) {
+	all, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	var match []*Container
+	for _, c := range all {
+		if c.Name == ref || c.ID == ref {
+			return c, nil
+		}
+		if strings.HasPrefix(c.ID, ref) {
+			match = append(match, c)
+		}
+	}
+	switch len(match) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, ref)
+	case 1:
+		return match[0], nil
+	}
+	return nil, fmt.Errorf("container ID prefix %s is ambiguous", ref)
+}
+
+// Remove deletes the record and everything else in the container's dir
+func (s Store) Remove(id string) error {
+	unlock, err := lock(filepath.Join(s.Root, ".lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return os.RemoveAll(s.Dir(id))
+}
+
+// write replaces state.json atomically, readers never see half a record
+func (s Store) write(c *Container) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.Dir(c.ID), "state.json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func lock(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,140 @@
+package userns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// rootlessEnv carries the caller's real uid into the re-executed runtime
+const rootlessEnv = "MYRUNTIME_ROOTLESS_UID"
+
+// Rootless reports whether we run in the namespace set up by EnterRootless
+func Rootless() bool {
+	return os.Getenv(rootlessEnv) != ""
+}
+
+// RootlessUID is the host uid of the user that started a rootless runtime
+func RootlessUID() int {
+	uid, err := strconv.Atoi(os.Getenv(rootlessEnv))
+	if err != nil {
+		return os.Getuid()
+	}
+	return uid
+}
+
+// EnterRootless re-executes the runtime in a new user and mount namespace in
+// which the calling user is root, with the user's subordinate ids from
+// /etc/subuid and /etc/subgid mapped through newuidmap/newgidmap. Without
+// subordinate ids only the user itself is mapped. The caller exits with the
+// child's status; EnterRootless only returns in the child, once the maps are
+// in place.
+func EnterRootless() error {
+	if Rootless() {
+		// we are the child, wait for the parent to write our id maps
+		pipe := os.NewFile(3, "userns-sync")
+		buf := make([]byte, 1)
+		_, err := pipe.Read(buf)
+		pipe.Close()
+		if err != nil {
+			return fmt.Errorf("waiting for id maps: %w", err)
+		}
+		if buf[0] != 1 {
+			return errors.New("parent failed to set up id maps")
+		}
+		return nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), rootlessEnv+"="+strconv.Itoa(os.Getuid()))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{r}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting rootless namespace: %w", err)
+	}
+	r.Close()
+
+	if err := writeRootlessMaps(cmd.Process.Pid); err != nil {
+		w.Write([]byte{0})
+		cmd.Wait()
+		return err
+	}
+	w.Write([]byte{1})
+	w.Close()
+
+	// the child owns the terminal, ^C reaches it directly
+	signal.Ignore(syscall.SIGINT, syscall.SIGQUIT)
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
+
+func writeRootlessMaps(pid int) error {
+	uid, gid := os.Getuid(), os.Getgid()
+	names := []string{strconv.Itoa(uid)}
+	if u, err := user.Current(); err == nil {
+		names = []string{u.Username, u.Uid}
+	}
+	subUIDs, uerr := SubIDs("/etc/subuid", names)
+	subGIDs, gerr := SubIDs("/etc/subgid", names)
+	_, lerr := exec.LookPath("newuidmap")
+
+	if uerr != nil || gerr != nil || lerr != nil {
+		fmt.Fprintf(os.Stderr, "warn: no subordinate ids usable, mapping only uid %d to root\n", uid)
+		p := strconv.Itoa(pid)
+		if err := os.WriteFile("/proc/"+p+"/uid_map", []byte(fmt.Sprintf("0 %d 1", uid)), 0); err != nil {
+			return fmt.Errorf("write uid_map: %w", err)
+		}
+		if err := os.WriteFile("/proc/"+p+"/setgroups", []byte("deny"), 0); err != nil {
+			return fmt.Errorf("write setgroups: %w", err)
+		}
+		if err := os.WriteFile("/proc/"+p+"/gid_map", []byte(fmt.Sprintf("0 %d 1", gid)), 0); err != nil {
+			return fmt.Errorf("write gid_map: %w", err)
+		}
+		return nil
+	}
+
+	if err := newIDMap("newuidmap", pid, uid, subUIDs); err != nil {
+		return err
+	}
+	return newIDMap("newgidmap", pid, gid, subGIDs)
+}
+
+// newIDMap maps root to id and container ids from 1 upwards to the subordinate ranges
+func newIDMap(bin string, pid, id int, sub []IDMap) error {
+	args := []string{strconv.Itoa(pid), "0", strconv.Itoa(id), "1"}
+	next := 1
+	for _, r := range sub {
+		args = append(args, strconv.Itoa(next), strconv.Itoa(r.HostID), strconv.Itoa(r.Size))
+		next += r.Size
+	}
+	if out, err := exec.Command(bin, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v %s", bin, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package userns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DefaultSize is how many ids a container gets with -userns=auto
+const DefaultSize = 65536
+
+// IDMap maps Size ids starting at ContainerID to the host ids starting at HostID
+type IDMap struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// ParseIDMap parses comma-separated container:host:size ranges
+func ParseIDMap(s string) ([]IDMap, error) {
+	var maps []IDMap
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		f := strings.Split(part, ":")
+		if len(f) != 3 {
+			return nil, fmt.Errorf("invalid id map %q, want container:host:size", part)
+		}
+		var v [3]int
+		for i := range f {
+			n, err := strconv.Atoi(f[i])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid id map %q", part)
+			}
+			v[i] = n
+		}
+		if v[2] == 0 {
+			return nil, fmt.Errorf("invalid id map %q: empty range", part)
+		}
+		maps = append(maps, IDMap{ContainerID: v[0], HostID: v[1], Size: v[2]})
+	}
+	if len(maps) == 0 {
+		return nil, errors.New("empty id map")
+	}
+	return maps, nil
+}
+
+// HostID translates a container id, ok is false when id isn't mapped
+func HostID(maps []IDMap, id int) (int, bool) {
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
+// SysProcIDMap converts maps for syscall.SysProcAttr
+func SysProcIDMap(maps []IDMap) []syscall.SysProcIDMap {
+	out := make([]syscall.SysProcIDMap, 0, len(maps))
+	for _, m := range maps {
+		out = append(out, syscall.SysProcIDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size})
+	}
+	return out
+}
+
+// Auto allocates size uids and gids for a new container from the subordinate
+// ranges of the current user (or the "containers" user) in /etc/subuid and
+// /etc/subgid, skipping the taken ranges, which containers own whether they
+// run or not, and ranges mapped by running processes.
+func Auto(size int, takenUIDs, takenGIDs []IDMap) (uids, gids []IDMap, err error) {
+	names := []string{"containers"}
+	if u, err := user.Current(); err == nil {
+		names = []string{u.Username, u.Uid, "containers"}
+	}
+	uids, err = allocate("/etc/subuid", names, "uid_map", size, takenUIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	gids, err = allocate("/etc/subgid", names, "gid_map", size, takenGIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return uids, gids, nil
+}
+
+func allocate(subFile string, names []string, procMap string, size int, taken []IDMap) ([]IDMap, error) {
+	ranges, err := SubIDs(subFile, names)
+	if err != nil {
+		return nil, err
+	}
+	used := append(usedRanges(procMap), taken...)
+	for _, r := range ranges {
+		for start := r.HostID; start+size <= r.HostID+r.Size; {
+			conflict := false
+			for _, u := range used {
+				if start < u.HostID+u.Size && u.HostID < start+size {
+					conflict = true
+					start = u.HostID + u.Size
+					break
+				}
+			}
+			if !conflict {
+				return []IDMap{{ContainerID: 0, HostID: start, Size: size}}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no free range of %d ids in %s for %v", size, subFile, names)
+}
+
+// SubIDs returns the subordinate ranges listed for the first of names that has any.
+// ContainerID is left at 0.
+func SubIDs(path string, names []string) ([]IDMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	byName := map[string][]IDMap{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// user:start:count
+		parts := strings.Split(strings.TrimSpace(sc.Text()), ":")
+		if len(parts) != 3 || strings.HasPrefix(parts[0], "#") {
+			continue
+		}
+		start, err1 := strconv.Atoi(parts[1])
+		count, err2 := strconv.Atoi(parts[2])
+		if err1 != nil || err2 != nil || count <= 0 {
+			continue
+		}
+		byName[parts[0]] = append(byName[parts[0]], IDMap{HostID: start, Size: count})
+	}
+	for _, n := range names {
+		if r := byName[n]; len(r) > 0 {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("no entry for %v in %s", names, path)
+}
+
+// usedRanges collects the host ranges other user namespaces already map
+func usedRanges(procMap string) []IDMap {
+	var used []IDMap
+	paths, _ := filepath.Glob("/proc/[0-9]*/" + procMap)
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			f := strings.Fields(line)
+			if len(f) != 3 {
+				continue
+			}
+			host, _ := strconv.Atoi(f[1])
+			size, _ := strconv.Atoi(f[2])
+			if host == 0 && size == 4294967295 {
+				// initial namespace
+				continue
+			}
+			used = append(used, IDMap{HostID: host, Size: size})
+		}
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].HostID < used[j].HostID })
+	return used
+}
+
+// ShiftOwnership chowns every file under root from its container ids to the
+// matching host ids, so the tree looks right from inside the user namespace.
+func ShiftOwnership(root string, uids, gids []IDMap) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		uid, ok := HostID(uids, int(st.Uid))
+		if !ok {
+			uid = overflowID(uids)
+		}
+		gid, ok := HostID(gids, int(st.Gid))
+		if !ok {
+			gid = overflowID(gids)
+		}
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return fmt.Errorf("shift ownership of %s: %w", path, err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 && info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			// chown clears setuid/setgid
+			os.Chmod(path, info.Mode())
+		}
+		return nil
+	})
+}
+
+// overflowID is where unmapped ids end up: the host id of the container's nobody
+func overflowID(maps []IDMap) int {
+	if id, ok := HostID(maps, 65534); ok {
+		return id
+	}
+	return maps[0].HostID
+}